@@ -1,19 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"tweakio/config"
 	"tweakio/internal/api"
 	"tweakio/internal/cache"
 	"tweakio/internal/logger"
+	"tweakio/internal/metrics"
 	"tweakio/internal/parser"
 	"tweakio/internal/torznab"
 )
 
+const (
+	manifestCheckTimeout = time.Minute
+	// Failed checks are repeated sooner so a brief outage doesn't keep /ready failing for a whole interval
+	failedCheckInterval = 30 * time.Second
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var requestIDRegex = regexp.MustCompile("^[A-Za-z0-9_.-]{1,64}$")
+
+type sizedCache interface {
+	Len() int
+}
+
+type profile struct {
+	name             string
+	addons           []*api.Addon
+	estimatePackSize bool
+}
+
 func main() {
 	cfg, err := config.LoadConfig()
 	if err != nil {
@@ -21,9 +58,10 @@ func main() {
 		os.Exit(1)
 	}
 
-	if logger.DebugEnabled {
+	if logger.DebugEnabled() {
 		tmpConfig := *cfg
 		tmpConfig.TMDB.APIKey = "<REDACTED>"
+		tmpConfig.Server.APIKeys = nil
 		logger.Debug("TWEAKIO", "Config loaded:\n%+v", tmpConfig)
 	}
 
@@ -32,51 +70,492 @@ func main() {
 		os.Exit(1)
 	}
 
-	httpClient := api.NewAPIClient(cfg.TorrentioURL, cfg.ProxyURL, cfg.TMDB.APIKey)
+	addons, profiles, err := buildProfiles(cfg)
+	if err != nil {
+		logger.Error("TWEAKIO", "%v", err)
+		os.Exit(1)
+	}
+
+	torznab.DefaultTrackers = cfg.Trackers
+
+	httpClient := api.NewAPIClient(addons, cfg.ProxyURL, cfg.TMDB.APIKey)
+	httpClient.Client.Timeout = cfg.HTTP.Timeout
+	httpClient.MaxRetries = cfg.HTTP.MaxRetries
+	httpClient.RetryBackoff = cfg.HTTP.RetryBackoff
+	httpClient.LookupTimeout = cfg.Server.SearchTimeout
+	if cfg.StreamCache.Size > 0 {
+		httpClient.StreamCache = cache.CreateStreamCache[api.Stream](cfg.StreamCache.Size, cfg.StreamCache.TTL, cfg.StreamCache.EmptyTTL)
+	}
+
+	for _, addon := range addons {
+		if providers := addon.Providers(); len(providers) > 0 {
+			logger.Info(addon.LogSource(), "Configured providers: %s", strings.Join(providers, ", "))
+		}
+
+		err := httpClient.CheckManifest(context.Background(), addon)
+		if errors.Is(err, api.ErrInvalidManifest) {
+			logger.Error("TWEAKIO", "%s does not point at a usable stream addon, check its base URL and options: %v", addon.Name, err)
+			os.Exit(1)
+		}
+		if err != nil {
+			logger.Warn("TWEAKIO", "Could not reach %s, searches will fail until it recovers: %v", addon.Name, err)
+		}
+	}
 
 	var episodeCache *cache.EpisodeCache
+	var idCache *cache.IDCache
 	if cfg.TMDB.APIKey != "" {
-		episodeCache = cache.CreateEpisodeCache(cfg.TMDB.CacheSize)
+		if err := httpClient.CheckTMDB(context.Background()); err != nil {
+			logger.Warn("TWEAKIO", "Could not reach TMDB, text searches and pack sizes will be degraded until it recovers: %v", err)
+		}
+		episodeCache = cache.CreateEpisodeCache(cfg.TMDB.CacheSize, cfg.TMDB.CacheTTL, cfg.TMDB.CacheAiringTTL)
+		idCache = cache.CreateIDCache(cfg.TMDB.CacheSize)
+	}
+
+	go refreshUpstreamStatus(httpClient, cfg.Server.HealthCheckInterval, manifestCheckTimeout)
+
+	caches := configuredCaches(httpClient.StreamCache, episodeCache, idCache)
+	registerCacheMetrics(caches)
+
+	// Run after in-flight searches have finished, so nothing they cache is lost
+	var shutdownHooks []func()
+	if episodeCache != nil && cfg.TMDB.CacheFile != "" {
+		shutdownHooks = append(shutdownHooks, persistEpisodeCache(episodeCache, cfg.TMDB.CacheFile, cfg.TMDB.CacheFlushInterval))
 	}
 
-	http.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
-		handleProwlarrRequest(w, r, httpClient, episodeCache)
+	mux := http.NewServeMux()
+
+	for _, p := range profiles {
+		pattern := "/api"
+		if p.name != "" {
+			pattern += "/" + p.name
+			logger.Info("TWEAKIO", "Serving profile %s at %s", p.name, pattern)
+		}
+		mux.HandleFunc(pattern, withRequestID(requireAPIKey(cfg.Server.APIKeys, func(w http.ResponseWriter, r *http.Request) {
+			handleProwlarrRequest(w, r, cfg.Server, p, httpClient, episodeCache, idCache)
+		})))
+	}
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		handleHealthRequest(w, r, httpClient, caches, false)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		handleHealthRequest(w, r, httpClient, caches, true)
 	})
 
-	logger.Info("TWEAKIO", "Running on port 3185")
-	if err := http.ListenAndServe(":3185", nil); err != nil {
-		logger.Error("TWEAKIO", "Failed to start: %v", err)
+	if len(cfg.Server.APIKeys) > 0 {
+		logger.Info("TWEAKIO", "API key authentication enabled with %d keys", len(cfg.Server.APIKeys))
+	}
+
+	server := &http.Server{
+		Addr:           net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port)),
+		Handler:        mux,
+		ReadTimeout:    cfg.Server.ReadTimeout,
+		WriteTimeout:   cfg.Server.WriteTimeout,
+		IdleTimeout:    cfg.Server.IdleTimeout,
+		MaxHeaderBytes: cfg.Server.MaxHeaderBytes,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		logger.Info("TWEAKIO", "Tweakio %s running on %s, reachable at %s", version, server.Addr, cfg.Server.BaseURL)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("TWEAKIO", "Failed to start: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(server, cfg.Server.ShutdownGracePeriod, shutdownHooks)
+}
+
+func shutdown(server *http.Server, gracePeriod time.Duration, hooks []func()) {
+	logger.Info("TWEAKIO", "Shutting down, waiting up to %s for in-flight searches", gracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("TWEAKIO", "Searches still running after %s were dropped: %v", gracePeriod, err)
+		server.Close()
+	}
+
+	for _, hook := range hooks {
+		hook()
+	}
+	logger.Info("TWEAKIO", "Shutdown complete")
+}
+
+// Addons shared between profiles are created once so they share health tracking
+func buildProfiles(cfg *config.Config) ([]*api.Addon, []profile, error) {
+	var addons []*api.Addon
+	addonsByName := make(map[string]*api.Addon)
+
+	getAddon := func(addonConfig config.AddonConfig) (*api.Addon, error) {
+		if addon, found := addonsByName[addonConfig.Name]; found {
+			return addon, nil
+		}
+		if !parser.SupportedFormat(addonConfig.Format) {
+			return nil, fmt.Errorf("unsupported addon format '%s', expected torrentio, knightcrawler, mediafusion, comet or generic", addonConfig.Format)
+		}
+		for _, upstream := range addonConfig.URLs {
+			logger.Info("TWEAKIO", "Using %s instance: %s", addonConfig.Name, upstream.Host)
+		}
+
+		addon := api.NewAddon(addonConfig.Name, addonConfig.Format, addonConfig.URLs, addonConfig.FanOut)
+		addonsByName[addon.Name] = addon
+		addons = append(addons, addon)
+		return addon, nil
+	}
+
+	profileConfigs := append([]config.ProfileConfig{{Addons: cfg.Addons, EstimatePackSize: true}}, cfg.Profiles...)
+	profiles := make([]profile, 0, len(profileConfigs))
+	for _, profileConfig := range profileConfigs {
+		p := profile{name: profileConfig.Name, estimatePackSize: profileConfig.EstimatePackSize}
+		for _, addonConfig := range profileConfig.Addons {
+			addon, err := getAddon(addonConfig)
+			if err != nil {
+				return nil, nil, err
+			}
+			p.addons = append(p.addons, addon)
+		}
+		profiles = append(profiles, p)
+	}
+
+	return addons, profiles, nil
+}
+
+func configuredCaches(streamCache *cache.StreamCache[api.Stream], episodeCache *cache.EpisodeCache, idCache *cache.IDCache) map[string]sizedCache {
+	caches := make(map[string]sizedCache)
+	if streamCache != nil {
+		caches["streams"] = streamCache
+	}
+	if episodeCache != nil {
+		caches["episodes"] = episodeCache
+		caches["ids"] = idCache
+	}
+	return caches
+}
+
+func registerCacheMetrics(caches map[string]sizedCache) {
+	for _, name := range slices.Sorted(maps.Keys(caches)) {
+		metrics.NewGaugeFunc("tweakio_cache_entries", "Entries currently held by a cache.", map[string]string{"cache": name}, func() float64 {
+			return float64(caches[name].Len())
+		})
+	}
+}
+
+// Returns a hook that saves the cache one last time on shutdown
+func persistEpisodeCache(episodeCache *cache.EpisodeCache, path string, interval time.Duration) func() {
+	if loaded, err := episodeCache.Load(path); err != nil {
+		logger.Warn("CACHE", "Ignoring episode cache file %s: %v", path, err)
+	} else {
+		logger.Info("CACHE", "Loaded %d shows from %s", loaded, path)
+	}
+
+	flush := func() {
+		if err := episodeCache.Save(path); err != nil {
+			logger.Error("CACHE", "Failed to save episode cache: %v", err)
+		}
+	}
+
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				flush()
+			}
+		}()
+	}
+
+	return func() {
+		logger.Info("CACHE", "Saving episode cache to %s", path)
+		flush()
+	}
+}
+
+// Upstreams are rechecked in the background so /ready only reads their last status,
+// and a probe that gives up early can't abandon a slow check before it is recorded
+func refreshUpstreamStatus(httpClient *api.APIClient, interval, timeout time.Duration) {
+	for {
+		wait := interval
+		failed := slices.ContainsFunc(httpClient.Addons, func(addon *api.Addon) bool { return addon.ManifestStatus().Err != nil })
+		if failed || httpClient.TMDBAPIKey != "" && httpClient.TMDBStatus().Err != nil {
+			wait = min(failedCheckInterval, interval)
+		}
+		time.Sleep(wait)
+
+		for _, addon := range httpClient.Addons {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			httpClient.CheckManifest(ctx, addon)
+			cancel()
+		}
+
+		if httpClient.TMDBAPIKey != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			httpClient.CheckTMDB(ctx)
+			cancel()
+		}
+	}
+}
+
+// A search that succeeds after a failed check shows the addon has recovered before it is rechecked
+func addonHealthy(addon *api.Addon) bool {
+	if addon.ManifestStatus().Err == nil {
+		return true
+	}
+	return slices.ContainsFunc(addon.Upstreams, func(upstream *api.Upstream) bool { return upstream.LastError() == nil })
+}
+
+// Requests keep the ID given by a proxy in front of Tweakio so log lines can be correlated across both
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !requestIDRegex.MatchString(requestID) {
+			id := make([]byte, 8)
+			rand.Read(id)
+			requestID = hex.EncodeToString(id)
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		next(w, r.WithContext(logger.WithRequestID(r.Context(), requestID)))
+	}
+}
+
+func requireAPIKey(apiKeys map[string]string, next http.HandlerFunc) http.HandlerFunc {
+	if len(apiKeys) == 0 {
+		return next
+	}
 
+	return func(w http.ResponseWriter, r *http.Request) {
+		provided := []byte(r.URL.Query().Get("apikey"))
+		client, matched := "", false
+		for key, name := range apiKeys {
+			if subtle.ConstantTimeCompare(provided, []byte(key)) == 1 {
+				client, matched = name, true
+			}
+		}
+
+		if !matched {
+			logger.WarnContext(r.Context(), "TWEAKIO", "Rejected request from %s with an invalid API key", r.RemoteAddr)
+			sendError(r.Context(), w, torznab.ErrorIncorrectCredentials, "Incorrect user credentials")
+			return
+		}
+
+		logger.DebugContext(r.Context(), "TWEAKIO", "Authenticated request from %s", client)
+		next(w, r)
 	}
 }
 
-func handleProwlarrRequest(w http.ResponseWriter, r *http.Request, httpClient *api.APIClient, episodeCache *cache.EpisodeCache) {
+// Both only report the last known state so probes never wait on upstreams,
+// but /ready fails until every addon serves a valid manifest or answers a search
+func handleHealthRequest(w http.ResponseWriter, r *http.Request, httpClient *api.APIClient, caches map[string]sizedCache, ready bool) {
+	type upstreamHealth struct {
+		Host    string `json:"host"`
+		Healthy bool   `json:"healthy"`
+		Error   string `json:"error,omitempty"`
+	}
+	type addonHealth struct {
+		Name      string           `json:"name"`
+		Healthy   bool             `json:"healthy"`
+		Manifest  string           `json:"manifest,omitempty"`
+		Error     string           `json:"error,omitempty"`
+		CheckedAt time.Time        `json:"checked_at"`
+		Upstreams []upstreamHealth `json:"upstreams"`
+	}
+	type tmdbHealth struct {
+		Configured bool       `json:"configured"`
+		Reachable  bool       `json:"reachable"`
+		Error      string     `json:"error,omitempty"`
+		CheckedAt  *time.Time `json:"checked_at,omitempty"`
+	}
+
+	response := struct {
+		Status  string          `json:"status"`
+		Version string          `json:"version"`
+		Checks  map[string]bool `json:"checks"`
+		Addons  []addonHealth   `json:"addons"`
+		TMDB    tmdbHealth      `json:"tmdb"`
+		Caches  map[string]int  `json:"caches"`
+	}{
+		Status:  "ok",
+		Version: version,
+		Checks:  map[string]bool{"config": true, "regexes": parser.Regexes != nil, "addons": true},
+		Caches:  make(map[string]int),
+	}
+
+	for _, addon := range httpClient.Addons {
+		manifestStatus := addon.ManifestStatus()
+
+		health := addonHealth{Name: addon.Name, Healthy: addonHealthy(addon), CheckedAt: manifestStatus.CheckedAt}
+		if manifestStatus.Manifest != nil {
+			health.Manifest = manifestStatus.Manifest.Name + " v" + manifestStatus.Manifest.Version
+		}
+		if manifestStatus.Err != nil {
+			health.Error = logger.Redact(manifestStatus.Err.Error())
+		}
+		if !health.Healthy {
+			response.Checks["addons"] = false
+		}
+		for _, upstream := range addon.Upstreams {
+			upstreamStatus := upstreamHealth{Host: upstream.URL.Host, Healthy: upstream.Healthy()}
+			if err := upstream.LastError(); err != nil {
+				upstreamStatus.Error = logger.Redact(err.Error())
+			}
+			health.Upstreams = append(health.Upstreams, upstreamStatus)
+		}
+		response.Addons = append(response.Addons, health)
+	}
+
+	if httpClient.TMDBAPIKey != "" {
+		tmdbStatus := httpClient.TMDBStatus()
+
+		response.TMDB = tmdbHealth{Configured: true, Reachable: tmdbStatus.Err == nil, CheckedAt: &tmdbStatus.CheckedAt}
+		if tmdbStatus.Err != nil {
+			response.TMDB.Error = logger.Redact(tmdbStatus.Err.Error())
+		}
+	}
+
+	for name, c := range caches {
+		response.Caches[name] = c.Len()
+	}
+
+	statusCode := http.StatusOK
+	if ready {
+		response.Status = "ready"
+		// TMDB is only needed for text searches and pack sizes, so it is reported but doesn't block readiness
+		for _, passed := range response.Checks {
+			if !passed {
+				response.Status = "not ready"
+				statusCode = http.StatusServiceUnavailable
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.ErrorContext(r.Context(), "TWEAKIO", "Error writing response: %v", err)
+	}
+}
+
+func handleProwlarrRequest(w http.ResponseWriter, r *http.Request, serverConfig config.ServerConfig, p profile, httpClient *api.APIClient, episodeCache *cache.EpisodeCache, idCache *cache.IDCache) {
+	// Upstream calls stop when the client gives up or the search runs out of time
+	ctx, cancel := context.WithTimeout(r.Context(), serverConfig.SearchTimeout)
+	defer cancel()
 	query := r.URL.Query()
+	baseURL := publicBaseURL(r, serverConfig)
+	apiPath := r.URL.Path
 	t := query.Get("t")
 	imdbID := query.Get("imdbid")
+	tvdbID := query.Get("tvdbid")
+	tmdbID := query.Get("tmdbid")
+	q := query.Get("q")
 	season, _ := strconv.Atoi(query.Get("season"))
 	episode, _ := strconv.Atoi(query.Get("ep"))
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	categories := torznab.ParseCategories(query.Get("cat"))
 
-	logger.Info("TWEAKIO", "Received request: type=%s, imdbID=%s, season=%d, episode=%d", t, imdbID, season, episode)
+	// Anything other than the known types is grouped together to keep the number of series bounded
+	searchType := t
+	if !slices.Contains([]string{"search", "tvsearch", "movie", "rss", "caps"}, t) {
+		searchType = "invalid"
+	}
+	outcome := "error"
+	defer func() {
+		metrics.Requests.Inc(searchType, outcome)
+	}()
+
+	logger.InfoContext(ctx, "TWEAKIO", "Received request: profile=%s, type=%s, q=%s, imdbID=%s, tvdbID=%s, tmdbID=%s, season=%d, episode=%d, offset=%d, limit=%d, categories=%v", p.name, t, q, imdbID, tvdbID, tmdbID, season, episode, offset, limit, categories)
 
 	if t == "rss" {
-		sendResponse(w, torznab.RssResponse())
+		outcome = "success"
+		sendResponse(ctx, w, torznab.RssResponse())
 		return
 	}
 
 	if t == "caps" {
-		sendResponse(w, torznab.CapsResponse())
+		outcome = "success"
+		sendResponse(ctx, w, torznab.CapsResponse())
+		return
+	}
+
+	switch t {
+	case "search", "tvsearch", "movie":
+	case "":
+		sendError(ctx, w, torznab.ErrorMissingParameter, "Missing parameter (t)")
+		return
+	case "music", "book":
+		sendError(ctx, w, torznab.ErrorFunctionUnavailable, "Function not available ("+t+")")
+		return
+	default:
+		sendError(ctx, w, torznab.ErrorNoSuchFunction, "No such function ("+t+")")
+		return
+	}
+
+	if _, err := strconv.Atoi(strings.TrimPrefix(imdbID, "tt")); imdbID != "" && err != nil {
+		sendError(ctx, w, torznab.ErrorIncorrectParameter, "Incorrect parameter (imdbid)")
 		return
 	}
 
+	if imdbID == "" && (tvdbID != "" || tmdbID != "") && httpClient.TMDBAPIKey != "" {
+		resolvedID, resolvedType, err := resolveExternalID(ctx, httpClient, idCache, t, tvdbID, tmdbID)
+		if errors.Is(err, api.ErrNoResults) {
+			logger.InfoContext(ctx, "TMDB", "No IMDb ID found for tvdbID=%s, tmdbID=%s: %v", tvdbID, tmdbID, err)
+			outcome = "empty"
+			sendEmptyResponse(ctx, w, baseURL, apiPath, offset)
+			return
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "TMDB", "Error resolving tvdbID=%s, tmdbID=%s: %v", tvdbID, tmdbID, err)
+			sendUpstreamError(ctx, w, "TMDB", err)
+			return
+		}
+
+		logger.InfoContext(ctx, "TMDB", "Resolved tvdbID=%s, tmdbID=%s to %s (%s)", tvdbID, tmdbID, resolvedID, resolvedType)
+		imdbID, t = resolvedID, resolvedType
+	}
+
+	if imdbID == "" && q != "" && httpClient.TMDBAPIKey != "" {
+		searchQuery := parser.ParseQuery(q)
+		if season == 0 {
+			season = searchQuery.Season
+		}
+		if episode == 0 {
+			episode = searchQuery.Episode
+		}
+		if t == "search" && season > 0 {
+			t = "tvsearch"
+		}
+
+		resolvedID, resolvedType, err := resolveQuery(ctx, httpClient, t, searchQuery)
+		if errors.Is(err, api.ErrNoResults) {
+			logger.InfoContext(ctx, "TMDB", "No match for query '%s': %v", q, err)
+			outcome = "empty"
+			sendEmptyResponse(ctx, w, baseURL, apiPath, offset)
+			return
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "TMDB", "Error resolving query '%s': %v", q, err)
+			sendUpstreamError(ctx, w, "TMDB", err)
+			return
+		}
+
+		logger.InfoContext(ctx, "TMDB", "Resolved query '%s' to %s (%s)", q, resolvedID, resolvedType)
+		imdbID, t = resolvedID, resolvedType
+	}
+
 	if imdbID == "" {
-		fakeResults, err := torznab.GenerateFakeResults()
+		fakeResults, err := torznab.GenerateFakeResults(baseURL, apiPath)
 		if err != nil {
-			logger.Error("TWEAKIO", "Error generating placeholder results: %v", err)
-			sendError(w)
+			logger.ErrorContext(ctx, "TWEAKIO", "Error generating placeholder results: %v", err)
+			sendError(ctx, w, torznab.ErrorUnknown, "Internal error")
 			return
 		}
-		sendResponse(w, fakeResults)
+		outcome = "placeholder"
+		sendResponse(ctx, w, fakeResults)
 		return
 	}
 
@@ -89,47 +568,209 @@ func handleProwlarrRequest(w http.ResponseWriter, r *http.Request, httpClient *a
 		mediaType = "series"
 	}
 
-	results, err := httpClient.FetchFromTorrentio(mediaType, imdbID, season, episode)
-	if err != nil {
-		logger.Error("TORRENTIO", "Error fetching results: %v", err)
-		sendError(w)
+	seasonSearch := mediaType == "series" && season > 0 && episode == 0
+
+	episodeCount := 0
+	if seasonSearch {
+		episodeCount = parser.GetOrFetchEpisodes(ctx, imdbID, season, season, httpClient, episodeCache)
+	}
+
+	responses := httpClient.FetchFromAddons(p.addons, func(addon *api.Addon) ([]api.Stream, error) {
+		if seasonSearch {
+			return httpClient.FetchSeasonFromAddon(ctx, addon, imdbID, season, episodeCount)
+		}
+		return httpClient.FetchFromAddon(ctx, addon, mediaType, imdbID, season, episode)
+	})
+
+	if err := r.Context().Err(); err != nil {
+		outcome = "canceled"
+		logger.InfoContext(ctx, "TWEAKIO", "Client went away, dropping search: %v", err)
 		return
 	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.WarnContext(ctx, "TWEAKIO", "Search ran out of time after %s, returning partial results", serverConfig.SearchTimeout)
+	}
 
 	parseStart := time.Now()
 
 	var parsedResults []parser.TorrentioResult
-	for _, result := range results {
-		torrentioResult, err := parser.ParseResult(result, t, imdbID, httpClient, episodeCache)
-		if err != nil {
-			logger.Error("TORRENTIO", "Error parsing result: %v", err)
-		} else {
-			parsedResults = append(parsedResults, *torrentioResult)
+	var fetchErrs []error
+	for _, response := range responses {
+		if response.Err != nil {
+			logger.ErrorContext(ctx, response.Addon.LogSource(), "Error fetching results: %v", response.Err)
+			fetchErrs = append(fetchErrs, response.Err)
+			continue
+		}
+
+		for _, stream := range response.Streams {
+			options := parser.Options{Format: response.Addon.Format, EstimatePackSize: p.estimatePackSize}
+			torrentioResult, err := parser.ParseResult(ctx, stream, options, t, imdbID, httpClient, episodeCache)
+			if err != nil {
+				metrics.ParseFailures.Inc(response.Addon.Name)
+				logger.ErrorContext(ctx, response.Addon.LogSource(), "Error parsing result: %v", err)
+			} else {
+				parsedResults = append(parsedResults, *torrentioResult)
+			}
 		}
 	}
+	if len(fetchErrs) == len(responses) {
+		upstream := "All addons"
+		if len(responses) == 1 {
+			upstream = responses[0].Addon.Name
+		}
+		sendUpstreamError(ctx, w, upstream, fetchErrs[0])
+		return
+	}
+
+	parsedResults = torznab.Deduplicate(parsedResults)
+
+	if seasonSearch {
+		sort.SliceStable(parsedResults, func(i, j int) bool {
+			return parsedResults[i].SeasonPack && !parsedResults[j].SeasonPack
+		})
+	}
+
+	parsedResults = torznab.FilterByCategories(parsedResults, categories)
+	page := torznab.Paginate(parsedResults, offset, limit)
+	metrics.SearchResults.Observe(float64(len(parsedResults)), searchType)
 
-	torznabResponse, err := torznab.ConvertToTorznab(parsedResults, "http://tweakio:3185/api")
+	search := torznab.SearchContext{IMDbID: imdbID, TMDBID: tmdbID, TVDBID: tvdbID, Season: season, Episode: episode}
+	torznabResponse, err := torznab.ConvertToTorznab(page, search, baseURL, apiPath, max(offset, 0), len(parsedResults))
 	if err != nil {
-		logger.Error("TWEAKIO", "Error convertng results to Torznab: %v", err)
-		sendError(w)
+		logger.ErrorContext(ctx, "TWEAKIO", "Error convertng results to Torznab: %v", err)
+		sendError(ctx, w, torznab.ErrorUnknown, "Internal error")
 		return
 	}
 
 	parseDuration := time.Since(parseStart).Seconds()
-	logger.Info("TWEAKIO", "Processed %d results in %f sec", len(parsedResults), parseDuration)
+	logger.InfoContext(ctx, "TWEAKIO", "Processed %d results in %f sec, returning %d", len(parsedResults), parseDuration, len(page))
 
-	sendResponse(w, torznabResponse)
+	outcome = "success"
+	if len(parsedResults) == 0 {
+		outcome = "empty"
+	}
+
+	sendResponse(ctx, w, torznabResponse)
 }
 
-func sendResponse(w http.ResponseWriter, response string) {
+func resolveQuery(ctx context.Context, httpClient *api.APIClient, t string, searchQuery parser.SearchQuery) (string, string, error) {
+	tmdbTypes := []string{"movie", "tv"}
+	switch t {
+	case "tvsearch":
+		tmdbTypes = []string{"tv"}
+	case "movie":
+		tmdbTypes = []string{"movie"}
+	}
+
+	var err error
+	for _, tmdbType := range tmdbTypes {
+		var imdbID string
+		imdbID, err = httpClient.SearchIMDbID(ctx, tmdbType, searchQuery.Title, searchQuery.Year)
+		if err == nil {
+			if tmdbType == "tv" {
+				return imdbID, "tvsearch", nil
+			}
+			return imdbID, "movie", nil
+		}
+		if !errors.Is(err, api.ErrNoResults) {
+			return "", "", err
+		}
+	}
+
+	return "", "", err
+}
+
+// TVDB IDs always belong to shows, so a plain search with one is searched as a show
+func resolveExternalID(ctx context.Context, httpClient *api.APIClient, idCache *cache.IDCache, t, tvdbID, tmdbID string) (string, string, error) {
+	source, id, resolvedType := "tmdb:movie", tmdbID, "movie"
+	if t == "tvsearch" {
+		source, resolvedType = "tmdb:tv", "tvsearch"
+	}
+	if tvdbID != "" && (t == "tvsearch" || tmdbID == "") {
+		source, id, resolvedType = "tvdb", tvdbID, "tvsearch"
+	}
+
+	if imdbID, found := idCache.Get(source, id); found {
+		return imdbID, resolvedType, nil
+	}
+
+	var imdbID string
+	var err error
+	switch source {
+	case "tvdb":
+		imdbID, err = httpClient.FetchIMDbIDFromTVDB(ctx, id)
+	case "tmdb:tv":
+		imdbID, err = httpClient.FetchIMDbIDFromTMDB(ctx, "tv", id)
+	default:
+		imdbID, err = httpClient.FetchIMDbIDFromTMDB(ctx, "movie", id)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	idCache.Set(source, id, imdbID)
+	return imdbID, resolvedType, nil
+}
+
+func publicBaseURL(r *http.Request, serverConfig config.ServerConfig) string {
+	baseURL := *serverConfig.BaseURL
+	if serverConfig.TrustForwardedHeaders {
+		if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto != "" {
+			baseURL.Scheme = proto
+		}
+		if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+			baseURL.Host = host
+		}
+		if prefix := firstHeaderValue(r, "X-Forwarded-Prefix"); prefix != "" {
+			baseURL.Path = "/" + strings.Trim(prefix, "/")
+		}
+	}
+	return strings.TrimSuffix(baseURL.String(), "/")
+}
+
+// Proxies append to forwarded headers, so the first value is the one the client used
+func firstHeaderValue(r *http.Request, key string) string {
+	value, _, _ := strings.Cut(r.Header.Get(key), ",")
+	return strings.TrimSpace(value)
+}
+
+func sendEmptyResponse(ctx context.Context, w http.ResponseWriter, baseURL, apiPath string, offset int) {
+	torznabResponse, err := torznab.ConvertToTorznab(nil, torznab.SearchContext{}, baseURL, apiPath, max(offset, 0), 0)
+	if err != nil {
+		logger.ErrorContext(ctx, "TWEAKIO", "Error converting results to Torznab: %v", err)
+		sendError(ctx, w, torznab.ErrorUnknown, "Internal error")
+		return
+	}
+	sendResponse(ctx, w, torznabResponse)
+}
+
+func sendResponse(ctx context.Context, w http.ResponseWriter, response string) {
 	w.Header().Set("Content-Type", "application/xml")
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte(response))
 	if err != nil {
-		logger.Error("TWEAKIO", "Error writing response: %v", err)
+		logger.ErrorContext(ctx, "TWEAKIO", "Error writing response: %v", err)
 	}
 }
 
-func sendError(w http.ResponseWriter) {
-	http.Error(w, "Internal server error", http.StatusInternalServerError)
+func sendError(ctx context.Context, w http.ResponseWriter, code int, description string) {
+	sendResponse(ctx, w, torznab.ErrorResponse(code, description))
+}
+
+// Errors are summarised rather than passed through, as they can contain URLs with API keys
+func sendUpstreamError(ctx context.Context, w http.ResponseWriter, upstream string, err error) {
+	var statusErr *api.StatusError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		sendError(ctx, w, torznab.ErrorRequestLimitReached, "Request limit reached")
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusForbidden:
+		sendError(ctx, w, torznab.ErrorUnknown, fmt.Sprintf("%s is unavailable (%s), it may be blocking this IP. Try setting PROXY_URL", upstream, statusErr.Status))
+	case errors.As(err, &statusErr):
+		sendError(ctx, w, torznab.ErrorUnknown, fmt.Sprintf("%s is unavailable (%s)", upstream, statusErr.Status))
+	case errors.As(err, &urlErr) && urlErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		sendError(ctx, w, torznab.ErrorUnknown, upstream+" is unavailable (timed out)")
+	default:
+		sendError(ctx, w, torznab.ErrorUnknown, upstream+" is unavailable")
+	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"tweakio/internal/api"
+	"tweakio/internal/cache"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	apiKeys := map[string]string{"c2VjcmV0==": "key1", "abc123": ""}
+	handler := requireAPIKey(apiKeys, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		query    string
+		accepted bool
+	}{
+		{"apikey=c2VjcmV0%3D%3D", true},
+		{"apikey=abc123", true},
+		{"apikey==", false},
+		{"apikey=c2VjcmV0", false},
+		{"apikey=", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/api?"+test.query, nil))
+		if accepted := recorder.Code == http.StatusNoContent; accepted != test.accepted {
+			t.Errorf("Query %q: expected accepted=%v, got status %d", test.query, test.accepted, recorder.Code)
+		}
+	}
+}
+
+func TestAddonHealthyAfterRecovery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "manifest.json") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"streams":[]}`))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	addon := api.NewAddon("torrentio", "torrentio", []*url.URL{serverURL}, false)
+	client := &api.APIClient{Client: server.Client()}
+
+	if err := client.CheckManifest(context.Background(), addon); err == nil || addonHealthy(addon) {
+		t.Fatalf("Expected the failed manifest check to make the addon unhealthy")
+	}
+	if _, err := client.FetchFromAddon(context.Background(), addon, "movie", "tt0000001", 0, 0); err != nil {
+		t.Fatalf("Unexpected search error: %v", err)
+	}
+	if !addonHealthy(addon) {
+		t.Errorf("Expected a successful search to make the addon healthy again")
+	}
+}
+
+func TestResolveExternalIDType(t *testing.T) {
+	idCache := cache.CreateIDCache(10)
+	idCache.Set("tvdb", "81189", "tt0903747")
+	idCache.Set("tmdb:movie", "438631", "tt1160419")
+
+	tests := []struct {
+		t, tvdbID, tmdbID, expected string
+	}{
+		{"search", "81189", "", "tvsearch"},
+		{"tvsearch", "81189", "", "tvsearch"},
+		{"search", "", "438631", "movie"},
+		{"movie", "", "438631", "movie"},
+	}
+
+	for _, test := range tests {
+		_, resolvedType, err := resolveExternalID(context.Background(), nil, idCache, test.t, test.tvdbID, test.tmdbID)
+		if err != nil || resolvedType != test.expected {
+			t.Errorf("t=%s tvdbid=%s tmdbid=%s: expected %s, got %s (%v)", test.t, test.tvdbID, test.tmdbID, test.expected, resolvedType, err)
+		}
+	}
+}
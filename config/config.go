@@ -2,36 +2,172 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"maps"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 	"tweakio/internal/logger"
 )
 
+var (
+	profileNameRegex = regexp.MustCompile("^[a-z0-9_-]+$")
+	clientNameRegex  = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+)
+
+var defaultTrackers = []string{
+	"udp://tracker.opentrackr.org:1337/announce",
+	"udp://open.demonii.com:1337/announce",
+	"udp://open.stealth.si:80/announce",
+	"udp://exodus.desync.com:6969/announce",
+	"udp://tracker.torrent.eu.org:451/announce",
+}
+
 type Config struct {
-	TorrentioURL *url.URL
-	TMDB         struct {
-		APIKey    string
-		CacheSize int
+	Server   ServerConfig
+	Addons   []AddonConfig
+	Profiles []ProfileConfig
+	TMDB     struct {
+		APIKey             string
+		CacheSize          int
+		CacheTTL           time.Duration
+		CacheAiringTTL     time.Duration
+		CacheFile          string
+		CacheFlushInterval time.Duration
 	}
 	ProxyURL *url.URL
+	// Added to every magnet link alongside the trackers reported by the addon
+	Trackers []string
+	HTTP     struct {
+		Timeout      time.Duration
+		MaxRetries   int
+		RetryBackoff time.Duration
+	}
+	StreamCache struct {
+		Size     int
+		TTL      time.Duration
+		EmptyTTL time.Duration
+	}
+}
+
+type ServerConfig struct {
+	Host                string
+	Port                int
+	BaseURL             *url.URL
+	ReadTimeout         time.Duration
+	WriteTimeout        time.Duration
+	IdleTimeout         time.Duration
+	MaxHeaderBytes      int
+	ShutdownGracePeriod time.Duration
+	SearchTimeout       time.Duration
+	HealthCheckInterval time.Duration
+	// API keys mapped to the name of the client using them
+	APIKeys map[string]string
+	// Only enable behind a reverse proxy that sets these headers, as clients can spoof them otherwise
+	TrustForwardedHeaders bool
+}
+
+type AddonConfig struct {
+	Name   string
+	Format string
+	URLs   []*url.URL
+	FanOut bool
+}
+
+type ProfileConfig struct {
+	Name             string
+	Addons           []AddonConfig
+	EstimatePackSize bool
 }
 
 func LoadConfig() (*Config, error) {
 	config := &Config{}
 
-	baseRaw := getEnv("TORRENTIO_BASE_URL", "https://torrentio.strem.fun/")
-	base, err := url.ParseRequestURI(baseRaw)
+	// DEBUG predates LOG_LEVEL and is kept as a shorthand for it
+	logLevel := "info"
+	if strings.ToLower(os.Getenv("DEBUG")) == "true" {
+		logLevel = "debug"
+	}
+	if err := logger.Configure(strings.ToLower(getEnv("LOG_FORMAT", "text")), strings.ToLower(getEnv("LOG_LEVEL", logLevel))); err != nil {
+		return nil, err
+	}
+	logger.Debug("TWEAKIO", "Debug mode enabled")
+
+	config.Server.Host = os.Getenv("HOST")
+	port, err := getEnvInt("PORT", 3185)
 	if err != nil {
 		return nil, err
 	}
+	if port < 1 || port > 65535 {
+		return nil, errors.New("PORT must be between 1 and 65535")
+	}
+	config.Server.Port = port
+
+	baseURL, err := url.ParseRequestURI(strings.TrimSuffix(getEnv("BASE_URL", fmt.Sprintf("http://tweakio:%d", port)), "/"))
+	if err != nil {
+		return nil, fmt.Errorf("BASE_URL is invalid: %w", err)
+	}
+	config.Server.BaseURL = baseURL
+	config.Server.TrustForwardedHeaders = strings.ToLower(os.Getenv("TRUST_FORWARDED_HEADERS")) == "true"
+
+	// Searches can take several upstream timeouts, so the write timeout has to cover a slow season search
+	if config.Server.ReadTimeout, err = getEnvDuration("SERVER_READ_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if config.Server.WriteTimeout, err = getEnvDuration("SERVER_WRITE_TIMEOUT", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if config.Server.IdleTimeout, err = getEnvDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if config.Server.MaxHeaderBytes, err = getEnvInt("SERVER_MAX_HEADER_BYTES", 64*1024); err != nil {
+		return nil, err
+	}
+	if config.Server.ShutdownGracePeriod, err = getEnvDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.Server.SearchTimeout, err = getEnvDuration("SEARCH_TIMEOUT", time.Minute); err != nil {
+		return nil, err
+	}
+	if config.Server.SearchTimeout <= 0 {
+		return nil, errors.New("SEARCH_TIMEOUT must be positive")
+	}
+	// A write timeout of 0 disables it, so any search timeout fits
+	if config.Server.WriteTimeout > 0 && config.Server.SearchTimeout >= config.Server.WriteTimeout {
+		return nil, errors.New("SEARCH_TIMEOUT must be shorter than SERVER_WRITE_TIMEOUT")
+	}
+	if config.Server.HealthCheckInterval, err = getEnvDuration("HEALTH_CHECK_INTERVAL", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if config.Server.HealthCheckInterval <= 0 {
+		return nil, errors.New("HEALTH_CHECK_INTERVAL must be positive")
+	}
+
+	if config.Server.APIKeys, err = parseAPIKeys(os.Getenv("API_KEYS")); err != nil {
+		return nil, err
+	}
+
 	torrentioOptions := getEnv("TORRENTIO_OPTIONS", "")
-	torrentioURL, err := base.Parse(torrentioOptions)
+	torrentioFanOut := strings.ToLower(os.Getenv("TORRENTIO_FANOUT")) == "true"
+	torrentio, err := torrentioAddon("torrentio", torrentioOptions, torrentioFanOut)
+	if err != nil {
+		return nil, err
+	}
+	config.Addons = append(config.Addons, torrentio)
+
+	addons, err := parseAddons(os.Getenv("STREMIO_ADDONS"))
 	if err != nil {
 		return nil, err
 	}
-	config.TorrentioURL = torrentioURL
+	config.Addons = append(config.Addons, addons...)
+
+	if config.Profiles, err = parseProfiles(config.Addons, torrentioOptions, torrentioFanOut); err != nil {
+		return nil, err
+	}
 
 	if key := os.Getenv("TMDB_API_KEY"); key != "" {
 		config.TMDB.APIKey = key
@@ -45,6 +181,18 @@ func LoadConfig() (*Config, error) {
 		} else {
 			config.TMDB.CacheSize = 1000
 		}
+
+		if config.TMDB.CacheTTL, err = getEnvDuration("TMDB_CACHE_TTL", 30*24*time.Hour); err != nil {
+			return nil, err
+		}
+		if config.TMDB.CacheAiringTTL, err = getEnvDuration("TMDB_CACHE_AIRING_TTL", 12*time.Hour); err != nil {
+			return nil, err
+		}
+
+		config.TMDB.CacheFile = os.Getenv("TMDB_CACHE_FILE")
+		if config.TMDB.CacheFlushInterval, err = getEnvDuration("TMDB_CACHE_FLUSH_INTERVAL", 5*time.Minute); err != nil {
+			return nil, err
+		}
 	}
 
 	proxy := getEnv("PROXY_URL", "")
@@ -56,15 +204,265 @@ func LoadConfig() (*Config, error) {
 		config.ProxyURL = proxyURL
 	}
 
-	logger.DebugEnabled = strings.ToLower(os.Getenv("DEBUG")) == "true"
-	logger.Debug("TWEAKIO", "Debug mode enabled")
+	if config.Trackers, err = parseTrackers(os.Getenv("TRACKERS")); err != nil {
+		return nil, err
+	}
+
+	if config.HTTP.Timeout, err = getEnvDuration("HTTP_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.HTTP.MaxRetries, err = getEnvInt("HTTP_MAX_RETRIES", 2); err != nil {
+		return nil, err
+	}
+	if config.HTTP.MaxRetries < 0 {
+		return nil, errors.New("HTTP_MAX_RETRIES must not be negative")
+	}
+	if config.HTTP.RetryBackoff, err = getEnvDuration("HTTP_RETRY_BACKOFF", 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if config.HTTP.RetryBackoff < 0 {
+		return nil, errors.New("HTTP_RETRY_BACKOFF must not be negative")
+	}
+
+	if config.StreamCache.Size, err = getEnvInt("STREAM_CACHE_SIZE", 500); err != nil {
+		return nil, err
+	}
+	if config.StreamCache.TTL, err = getEnvDuration("STREAM_CACHE_TTL", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if config.StreamCache.EmptyTTL, err = getEnvDuration("STREAM_CACHE_EMPTY_TTL", 2*time.Minute); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
 
+// Keys are comma separated and may be named to tell clients apart, e.g. "sonarr:abc123,radarr:def456".
+// The name is split off at a colon, which can't appear in hex or base64 keys, so padded keys stay intact
+func parseAPIKeys(raw string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for i, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, key, found := strings.Cut(entry, ":")
+		if !found {
+			name, key = fmt.Sprintf("key%d", i+1), entry
+		} else if !clientNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("API_KEYS entry %q must have a name made of letters, digits, '.', '_' or '-'", entry)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("API_KEYS entry %q has an empty key", entry)
+		}
+		if _, exists := keys[key]; exists {
+			return nil, fmt.Errorf("API_KEYS contains the key for %q more than once", name)
+		}
+		keys[key] = name
+	}
+	return keys, nil
+}
+
+// Trackers are comma separated announce URLs, or "none" to only use the ones reported by addons
+func parseTrackers(raw string) ([]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return defaultTrackers, nil
+	}
+	if strings.ToLower(raw) == "none" {
+		return nil, nil
+	}
+
+	var trackers []string
+	for tracker := range strings.SplitSeq(raw, ",") {
+		tracker = strings.TrimSpace(tracker)
+		if tracker == "" {
+			continue
+		}
+		if _, err := url.ParseRequestURI(tracker); err != nil {
+			return nil, fmt.Errorf("TRACKERS entry %q is not a valid URL", tracker)
+		}
+		trackers = append(trackers, tracker)
+	}
+	return trackers, nil
+}
+
+func torrentioAddon(name, options string, fanOut bool) (AddonConfig, error) {
+	torrentio := AddonConfig{Name: name, Format: "torrentio", FanOut: fanOut}
+	for baseRaw := range strings.SplitSeq(getEnv("TORRENTIO_BASE_URL", "https://torrentio.strem.fun/"), ",") {
+		baseRaw = strings.TrimSpace(baseRaw)
+		if baseRaw == "" {
+			continue
+		}
+		if !strings.HasSuffix(baseRaw, "/") {
+			baseRaw += "/"
+		}
+
+		base, err := url.ParseRequestURI(baseRaw)
+		if err != nil {
+			return AddonConfig{}, err
+		}
+		torrentioURL, err := base.Parse(options)
+		if err != nil {
+			return AddonConfig{}, err
+		}
+		torrentio.URLs = append(torrentio.URLs, torrentioURL)
+	}
+	if len(torrentio.URLs) == 0 {
+		return AddonConfig{}, errors.New("TORRENTIO_BASE_URL must contain at least one URL")
+	}
+	return torrentio, nil
+}
+
+// Profiles are listed in PROFILES and configured with PROFILE_<NAME>_* variables.
+// Each one starts from TORRENTIO_OPTIONS and overrides the providers, sort and quality filter.
+func parseProfiles(addons []AddonConfig, torrentioOptions string, torrentioFanOut bool) ([]ProfileConfig, error) {
+	var profiles []ProfileConfig
+	seen := make(map[string]bool)
+
+	for name := range strings.SplitSeq(os.Getenv("PROFILES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !profileNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("profile name %q may only contain letters, numbers, - and _", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("profile %q is defined more than once", name)
+		}
+		seen[name] = true
+
+		prefix := "PROFILE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		options := setOptions(getEnv(prefix+"OPTIONS", torrentioOptions), map[string]string{
+			"providers":     os.Getenv(prefix + "PROVIDERS"),
+			"sort":          os.Getenv(prefix + "SORT"),
+			"qualityfilter": os.Getenv(prefix + "QUALITY_FILTER"),
+		})
+
+		// "@" can't appear in STREMIO_ADDONS names such as "torrentio-2", so the two never collide
+		torrentio, err := torrentioAddon("torrentio@"+name, options, torrentioFanOut)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		profile := ProfileConfig{
+			Name:             name,
+			Addons:           []AddonConfig{torrentio},
+			EstimatePackSize: strings.ToLower(getEnv(prefix+"ESTIMATE_PACK_SIZE", "true")) == "true",
+		}
+
+		// Other addons are shared with the default profile, and all of them are used unless listed
+		if addonNames := os.Getenv(prefix + "ADDONS"); addonNames != "" {
+			profile.Addons = nil
+			for addonName := range strings.SplitSeq(addonNames, ",") {
+				addonName = strings.ToLower(strings.TrimSpace(addonName))
+				if addonName == "" {
+					continue
+				}
+				index := slices.IndexFunc(addons, func(addon AddonConfig) bool { return addon.Name == addonName })
+				if index < 0 {
+					return nil, fmt.Errorf("%sADDONS contains unknown addon %q", prefix, addonName)
+				}
+				addon := addons[index]
+				if index == 0 {
+					addon = torrentio
+				}
+				if !slices.ContainsFunc(profile.Addons, func(a AddonConfig) bool { return a.Name == addon.Name }) {
+					profile.Addons = append(profile.Addons, addon)
+				}
+			}
+		} else {
+			profile.Addons = append(profile.Addons, addons[1:]...)
+		}
+		if len(profile.Addons) == 0 {
+			return nil, fmt.Errorf("profile %s has no addons", name)
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+// Torrentio options are | separated key=value pairs, e.g. "providers=yts,eztv|sort=size"
+func setOptions(options string, overrides map[string]string) string {
+	var parts []string
+	for option := range strings.SplitSeq(options, "|") {
+		key, _, _ := strings.Cut(option, "=")
+		if option == "" || overrides[key] != "" {
+			continue
+		}
+		parts = append(parts, option)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(overrides)) {
+		if value := overrides[key]; value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+
+	return strings.Join(parts, "|")
+}
+
+// Addons are given as whitespace separated format=url entries, e.g.
+// "mediafusion=https://mediafusion.example/<config>/ comet=https://comet.example/<config>/"
+func parseAddons(raw string) ([]AddonConfig, error) {
+	var addons []AddonConfig
+	names := map[string]int{"torrentio": 1}
+
+	for _, entry := range strings.Fields(raw) {
+		format, rawURL, found := strings.Cut(entry, "=")
+		if !found || format == "" {
+			return nil, fmt.Errorf("STREMIO_ADDONS entry %q must be in the format format=url", entry)
+		}
+		format = strings.ToLower(format)
+
+		addonURL, err := url.ParseRequestURI(strings.TrimSuffix(rawURL, "/manifest.json"))
+		if err != nil {
+			return nil, fmt.Errorf("STREMIO_ADDONS entry %q has an invalid URL: %w", entry, err)
+		}
+
+		name := format
+		if names[format]++; names[format] > 1 {
+			name = fmt.Sprintf("%s-%d", format, names[format])
+		}
+
+		addons = append(addons, AddonConfig{Name: name, Format: format, URLs: []*url.URL{addonURL}})
+	}
+
+	return addons, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	num, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number", key)
+	}
+	return num, nil
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration such as 30s or 15m", key)
+	}
+	return duration, nil
+}
@@ -0,0 +1,86 @@
+package config
+
+import "testing"
+
+func TestParseProfiles(t *testing.T) {
+	t.Setenv("PROFILES", "anime,4k")
+	t.Setenv("PROFILE_ANIME_PROVIDERS", "nyaasi,horriblesubs")
+	t.Setenv("PROFILE_ANIME_ESTIMATE_PACK_SIZE", "false")
+	t.Setenv("PROFILE_4K_QUALITY_FILTER", "1080p,720p,480p,scr,cam")
+	t.Setenv("PROFILE_4K_ADDONS", "torrentio, torrentio-2")
+
+	addons := []AddonConfig{{Name: "torrentio", Format: "torrentio"}, {Name: "mediafusion", Format: "mediafusion"}, {Name: "torrentio-2", Format: "torrentio"}}
+	profiles, err := parseProfiles(addons, "providers=yts,eztv|sort=qualitysize", false)
+	if err != nil {
+		t.Fatalf("Failed to parse profiles: %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("Expected 2 profiles, got %d", len(profiles))
+	}
+
+	anime := profiles[0]
+	if got := anime.Addons[0].URLs[0].Path; got != "/sort=qualitysize|providers=nyaasi,horriblesubs" {
+		t.Errorf("Unexpected anime options: %s", got)
+	}
+	if anime.EstimatePackSize || len(anime.Addons) != 3 {
+		t.Errorf("Expected anime to skip pack size estimates and use all addons, got %+v", anime)
+	}
+
+	uhd := profiles[1]
+	if got := uhd.Addons[0].URLs[0].Path; got != "/providers=yts,eztv|sort=qualitysize|qualityfilter=1080p,720p,480p,scr,cam" {
+		t.Errorf("Unexpected 4k options: %s", got)
+	}
+	if !uhd.EstimatePackSize || len(uhd.Addons) != 2 || uhd.Addons[0].Name != "torrentio@4k" || uhd.Addons[1].Name != "torrentio-2" {
+		t.Errorf("Expected 4k to use its own Torrentio addon and the second Torrentio instance, got %+v", uhd)
+	}
+
+	t.Setenv("PROFILE_4K_ADDONS", "torrentio,mediafuson")
+	if _, err := parseProfiles(addons, "", false); err == nil {
+		t.Errorf("Expected an error for an unknown addon")
+	}
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys("sonarr:abc123, radarr:def456,ghi789,c2VjcmV0==")
+	if err != nil {
+		t.Fatalf("Failed to parse API keys: %v", err)
+	}
+
+	expected := map[string]string{"abc123": "sonarr", "def456": "radarr", "ghi789": "key3", "c2VjcmV0==": "key4"}
+	for key, name := range expected {
+		if keys[key] != name {
+			t.Errorf("Key %s: expected name %s, got %s", key, name, keys[key])
+		}
+	}
+
+	if len(keys) != len(expected) {
+		t.Errorf("Expected %d keys, got %v", len(expected), keys)
+	}
+
+	for _, raw := range []string{"sonarr:abc123,radarr:abc123", ":abc123", "sonarr:", "my client:abc123"} {
+		if _, err := parseAPIKeys(raw); err == nil {
+			t.Errorf("Expected an error for %q", raw)
+		}
+	}
+}
+
+func TestSearchTimeout(t *testing.T) {
+	tests := []struct {
+		searchTimeout, writeTimeout string
+		valid                       bool
+	}{
+		{"1m", "2m", true},
+		{"5m", "0", true},
+		{"2m", "2m", false},
+		{"0", "2m", false},
+		{"-1s", "0", false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("SEARCH_TIMEOUT", test.searchTimeout)
+		t.Setenv("SERVER_WRITE_TIMEOUT", test.writeTimeout)
+		if _, err := LoadConfig(); (err == nil) != test.valid {
+			t.Errorf("SEARCH_TIMEOUT=%s SERVER_WRITE_TIMEOUT=%s: expected valid=%v, got %v", test.searchTimeout, test.writeTimeout, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Addon is a Stremio stream addon following Torrentio's /stream/{type}/{id}.json
+// protocol. Format selects the parser used for its stream titles.
+type Addon struct {
+	Name      string
+	Format    string
+	Upstreams []*Upstream
+	FanOut    bool
+
+	mu             sync.Mutex
+	manifestStatus ManifestStatus
+}
+
+type AddonStreams struct {
+	Addon   *Addon
+	Streams []Stream
+	Err     error
+}
+
+func NewAddon(name, format string, urls []*url.URL, fanOut bool) *Addon {
+	return &Addon{
+		Name:      name,
+		Format:    format,
+		Upstreams: NewUpstreams(urls),
+		FanOut:    fanOut,
+	}
+}
+
+func (a *Addon) LogSource() string {
+	return strings.ToUpper(a.Name)
+}
+
+// Providers returns the providers selected in Torrentio style options, e.g. "providers=yts,eztv|sort=size"
+func (a *Addon) Providers() []string {
+	options := path.Base(a.Upstreams[0].URL.Path)
+	for option := range strings.SplitSeq(options, "|") {
+		if providers, found := strings.CutPrefix(option, "providers="); found {
+			return strings.Split(providers, ",")
+		}
+	}
+	return nil
+}
+
+func (a *Addon) ManifestStatus() ManifestStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.manifestStatus
+}
+
+func (a *Addon) setManifestStatus(status ManifestStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.manifestStatus = status
+}
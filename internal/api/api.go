@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,21 +11,41 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"tweakio/internal/cache"
 	"tweakio/internal/logger"
+	"tweakio/internal/metrics"
 )
 
+var ErrNoResults = errors.New("no results found")
+
 type APIClient struct {
-	TorrentioURL *url.URL
+	Addons       []*Addon
 	TMDBBaseURL  string
 	TMDBAPIKey   string
 	Client       *http.Client
+	StreamCache  *cache.StreamCache[Stream]
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Bounds lookups shared between searches, as they outlive the search that started them
+	LookupTimeout time.Duration
+
+	tvDetailsFlights flightGroup[map[string]any]
+	tmdbMu           sync.Mutex
+	tmdbStatus       TMDBStatus
+}
+
+type TMDBStatus struct {
+	Err       error
+	CheckedAt time.Time
 }
 
 type userAgentTransport struct {
 	base http.RoundTripper
 }
 
-func NewAPIClient(torrentioURL, proxyURL *url.URL, tmdbAPIKey string) *APIClient {
+func NewAPIClient(addons []*Addon, proxyURL *url.URL, tmdbAPIKey string) *APIClient {
 	baseTransport := http.DefaultTransport
 	if proxyURL != nil {
 		baseTransport = &http.Transport{
@@ -33,9 +54,9 @@ func NewAPIClient(torrentioURL, proxyURL *url.URL, tmdbAPIKey string) *APIClient
 	}
 
 	return &APIClient{
-		TorrentioURL: torrentioURL,
-		TMDBBaseURL:  "https://api.themoviedb.org/3",
-		TMDBAPIKey:   tmdbAPIKey,
+		Addons:      addons,
+		TMDBBaseURL: "https://api.themoviedb.org/3",
+		TMDBAPIKey:  tmdbAPIKey,
 		Client: &http.Client{
 			Transport: &userAgentTransport{
 				base: baseTransport,
@@ -49,8 +70,38 @@ func (u *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error
 	return u.base.RoundTrip(req)
 }
 
-func fetchJSON(httpClient *http.Client, url string, apiKey string, result any) error {
-	req, err := http.NewRequest("GET", url, nil)
+// The upstream names the addon or TMDB in metrics
+func (c *APIClient) fetchJSON(ctx context.Context, upstream, url, apiKey string, result any) error {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := fetchJSONOnce(ctx, c.Client, url, apiKey, result)
+		metrics.UpstreamDuration.Observe(time.Since(start).Seconds(), upstream)
+		if err == nil {
+			return nil
+		}
+		// The search was abandoned or ran out of time, which says nothing about the upstream
+		if ctx.Err() != nil {
+			return err
+		}
+
+		delay, retry := c.retryDelay(err, attempt)
+		if !retry {
+			metrics.UpstreamFailures.Inc(upstream)
+			return err
+		}
+
+		metrics.UpstreamRetries.Inc(upstream)
+		logger.WarnContext(ctx, "API", "Request failed, retrying in %s (%d/%d): %v", delay.Round(time.Millisecond), attempt+1, c.MaxRetries, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up retrying: %w", context.Cause(ctx))
+		}
+	}
+}
+
+func fetchJSONOnce(ctx context.Context, httpClient *http.Client, url string, apiKey string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request for URL %s: %w", url, err)
 	}
@@ -66,7 +117,11 @@ func fetchJSON(httpClient *http.Client, url string, apiKey string, result any) e
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API returned an error: %s", resp.Status)
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -81,10 +136,8 @@ func fetchJSON(httpClient *http.Client, url string, apiKey string, result any) e
 	return nil
 }
 
-func (c *APIClient) FetchFromTorrentio(mediaType, imdbID string, season, episode int) ([]any, error) {
-	url := *c.TorrentioURL
-
-	url.Path = path.Join(url.Path, "stream", mediaType, imdbID)
+func (c *APIClient) FetchFromAddon(ctx context.Context, addon *Addon, mediaType, imdbID string, season, episode int) ([]Stream, error) {
+	streamPath := path.Join("stream", mediaType, imdbID)
 
 	if mediaType == "series" {
 		if season == 0 {
@@ -93,40 +146,187 @@ func (c *APIClient) FetchFromTorrentio(mediaType, imdbID string, season, episode
 		if episode == 0 {
 			episode = 1
 		}
-		url.Path += fmt.Sprintf(":%d:%d", season, episode)
+		streamPath += fmt.Sprintf(":%d:%d", season, episode)
 	}
 
-	url.Path += ".json"
+	streamPath += ".json"
 
-	logger.Info("TORRENTIO", "Fetching results from: %s", url.String())
+	// Every upstream of an addon shares the same options, so the primary URL identifies the request
+	cacheKey := addon.Upstreams[0].streamURL(streamPath)
+	if c.StreamCache != nil {
+		if streams, found := c.StreamCache.Get(cacheKey); found {
+			logger.InfoContext(ctx, addon.LogSource(), "Using cached results for: %s", cacheKey)
+			return streams, nil
+		}
+	}
 
-	var result map[string]any
-	if err := fetchJSON(c.Client, url.String(), "", &result); err != nil {
+	var streams []Stream
+	var err error
+	if addon.FanOut {
+		streams, err = c.fetchFromAllUpstreams(ctx, addon, streamPath)
+	} else {
+		streams, err = c.fetchWithFailover(ctx, addon, streamPath)
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	streams, ok := result["streams"].([]any)
-	if !ok {
-		return nil, errors.New("invalid result structure")
+	if c.StreamCache != nil {
+		c.StreamCache.Set(cacheKey, streams)
 	}
 
 	return streams, nil
 }
 
-func fetchIdFromTMDB(c *APIClient, imdbID string) (string, error) {
-	baseUrl := fmt.Sprintf("%s/find/%s?external_source=imdb_id", c.TMDBBaseURL, imdbID)
+func (c *APIClient) fetchWithFailover(ctx context.Context, addon *Addon, streamPath string) ([]Stream, error) {
+	var err error
+	for _, upstream := range orderUpstreams(addon.Upstreams) {
+		var streams []Stream
+		if streams, err = c.fetchFromUpstream(ctx, addon, upstream, streamPath); err == nil {
+			return streams, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (c *APIClient) fetchFromAllUpstreams(ctx context.Context, addon *Addon, streamPath string) ([]Stream, error) {
+	var upstreams []*Upstream
+	for _, upstream := range addon.Upstreams {
+		if upstream.Healthy() {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	if len(upstreams) == 0 {
+		upstreams = addon.Upstreams
+	}
+
+	responses := make([][]Stream, len(upstreams))
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Go(func() {
+			responses[i], errs[i] = c.fetchFromUpstream(ctx, addon, upstream, streamPath)
+		})
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == len(upstreams) {
+		return nil, errors.Join(errs...)
+	}
+
+	return mergeStreams(responses), nil
+}
+
+func (c *APIClient) fetchFromUpstream(ctx context.Context, addon *Addon, upstream *Upstream, streamPath string) ([]Stream, error) {
+	streamURL := upstream.streamURL(streamPath)
+	logger.InfoContext(ctx, addon.LogSource(), "Fetching results from: %s", streamURL)
+
+	var result struct {
+		Streams []json.RawMessage `json:"streams"`
+	}
+	err := c.fetchJSON(ctx, addon.Name, streamURL, "", &result)
+	if err == nil && result.Streams == nil {
+		err = errors.New("invalid result structure")
+	}
+	if err != nil && ctx.Err() != nil {
+		logger.InfoContext(ctx, addon.LogSource(), "Stopped fetching from %s: %v", upstream.URL.Host, context.Cause(ctx))
+		return nil, err
+	}
+	if err != nil {
+		cooldown := upstream.markFailure(err)
+		logger.WarnContext(ctx, addon.LogSource(), "Upstream %s failed, skipping it for %s: %v", upstream.URL.Host, cooldown, err)
+		return nil, err
+	}
+
+	upstream.markSuccess()
+	return decodeStreams(ctx, addon, result.Streams), nil
+}
+
+func (c *APIClient) tmdbURL(endpoint string, params url.Values) string {
+	if params == nil {
+		params = url.Values{}
+	}
 	if !strings.HasPrefix(c.TMDBAPIKey, "eyJ") {
-		baseUrl = fmt.Sprintf("%s&api_key=%s", baseUrl, c.TMDBAPIKey)
+		params.Set("api_key", c.TMDBAPIKey)
+	}
+
+	baseUrl := c.TMDBBaseURL + endpoint
+	if encoded := params.Encode(); encoded != "" {
+		baseUrl += "?" + encoded
+	}
+	return baseUrl
+}
+
+func (c *APIClient) FetchSeasonFromAddon(ctx context.Context, addon *Addon, imdbID string, season, episodeCount int) ([]Stream, error) {
+	// Packs are returned for every episode they contain, so sampling the start,
+	// middle and end of the season finds packs without querying every episode
+	episodes := []int{1}
+	for _, episode := range []int{(episodeCount + 1) / 2, episodeCount} {
+		if episode > episodes[len(episodes)-1] {
+			episodes = append(episodes, episode)
+		}
 	}
 
+	logger.InfoContext(ctx, addon.LogSource(), "Season search for %s season %d using episodes %v", imdbID, season, episodes)
+
+	responses := make([][]Stream, len(episodes))
+	errs := make([]error, len(episodes))
+	var wg sync.WaitGroup
+	for i, episode := range episodes {
+		wg.Go(func() {
+			responses[i], errs[i] = c.FetchFromAddon(ctx, addon, "series", imdbID, season, episode)
+		})
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			logger.WarnContext(ctx, addon.LogSource(), "Error fetching season %d episode %d: %v", season, episodes[i], err)
+			failed++
+		}
+	}
+
+	if failed == len(episodes) {
+		return nil, errs[0]
+	}
+
+	return mergeStreams(responses), nil
+}
+
+func (c *APIClient) FetchFromAddons(addons []*Addon, fetch func(addon *Addon) ([]Stream, error)) []AddonStreams {
+	responses := make([]AddonStreams, len(addons))
+	var wg sync.WaitGroup
+	for i, addon := range addons {
+		wg.Go(func() {
+			streams, err := fetch(addon)
+			responses[i] = AddonStreams{Addon: addon, Streams: streams, Err: err}
+		})
+	}
+	wg.Wait()
+	return responses
+}
+
+func fetchIdFromTMDB(ctx context.Context, c *APIClient, externalID, externalSource string) (string, error) {
+	baseUrl := c.tmdbURL("/find/"+externalID, url.Values{"external_source": {externalSource}})
+
 	var result map[string]any
-	if err := fetchJSON(c.Client, baseUrl, c.TMDBAPIKey, &result); err != nil {
+	if err := c.fetchJSON(ctx, "tmdb", baseUrl, c.TMDBAPIKey, &result); err != nil {
 		return "", fmt.Errorf("failed to fetch TMDB ID: %w", err)
 	}
 
 	tvResults, ok := result["tv_results"].([]any)
 	if !ok || len(tvResults) == 0 {
-		return "", fmt.Errorf("no TMDB ID found for IMDB ID %s", imdbID)
+		return "", fmt.Errorf("%w: no TMDB ID found for %s %s", ErrNoResults, externalSource, externalID)
 	}
 
 	tvData, ok := tvResults[0].(map[string]any)
@@ -142,23 +342,115 @@ func fetchIdFromTMDB(c *APIClient, imdbID string) (string, error) {
 	return strconv.FormatFloat(tmdbID, 'f', 0, 64), nil
 }
 
-func (c *APIClient) FetchTVShowDetails(imdbID string) (map[string]any, error) {
-	logger.Info("TMDB", "Fetching TV show details")
+func (c *APIClient) FetchTVShowDetails(ctx context.Context, imdbID string) (map[string]any, error) {
+	result, err, shared := c.tvDetailsFlights.Do(ctx, imdbID, func() (map[string]any, error) {
+		// Other searches may be waiting on this lookup, so it must outlive the search that started it
+		lookupCtx := context.WithoutCancel(ctx)
+		if c.LookupTimeout > 0 {
+			var cancel context.CancelFunc
+			lookupCtx, cancel = context.WithTimeout(lookupCtx, c.LookupTimeout)
+			defer cancel()
+		}
+		return c.fetchTVShowDetails(lookupCtx, imdbID)
+	})
+	if shared {
+		logger.DebugContext(ctx, "TMDB", "Shared in-flight TV show details lookup for %s", imdbID)
+	}
+	return result, err
+}
+
+func (c *APIClient) fetchTVShowDetails(ctx context.Context, imdbID string) (map[string]any, error) {
+	logger.InfoContext(ctx, "TMDB", "Fetching TV show details for %s", imdbID)
 
-	tmdbID, err := fetchIdFromTMDB(c, imdbID)
+	tmdbID, err := fetchIdFromTMDB(ctx, c, imdbID, "imdb_id")
 	if err != nil {
 		return nil, err
 	}
 
-	baseUrl := fmt.Sprintf("%s/tv/%s", c.TMDBBaseURL, tmdbID)
-	if !strings.HasPrefix(c.TMDBAPIKey, "eyJ") {
-		baseUrl = fmt.Sprintf("%s?api_key=%s", baseUrl, c.TMDBAPIKey)
-	}
+	baseUrl := c.tmdbURL("/tv/"+tmdbID, nil)
 
 	var result map[string]any
-	if err := fetchJSON(c.Client, baseUrl, c.TMDBAPIKey, &result); err != nil {
+	if err := c.fetchJSON(ctx, "tmdb", baseUrl, c.TMDBAPIKey, &result); err != nil {
 		return nil, fmt.Errorf("failed to fetch TV show details: %w", err)
 	}
 
 	return result, nil
 }
+
+func (c *APIClient) SearchIMDbID(ctx context.Context, tmdbType, title string, year int) (string, error) {
+	logger.InfoContext(ctx, "TMDB", "Searching %s for '%s' (year=%d)", tmdbType, title, year)
+
+	params := url.Values{"query": {title}}
+	if year > 0 {
+		if tmdbType == "tv" {
+			params.Set("first_air_date_year", strconv.Itoa(year))
+		} else {
+			params.Set("year", strconv.Itoa(year))
+		}
+	}
+
+	var result struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+	if err := c.fetchJSON(ctx, "tmdb", c.tmdbURL("/search/"+tmdbType, params), c.TMDBAPIKey, &result); err != nil {
+		return "", fmt.Errorf("failed to search TMDB: %w", err)
+	}
+
+	if len(result.Results) == 0 {
+		return "", fmt.Errorf("%w on TMDB for '%s'", ErrNoResults, title)
+	}
+
+	return c.FetchIMDbIDFromTMDB(ctx, tmdbType, strconv.Itoa(result.Results[0].ID))
+}
+
+func (c *APIClient) FetchIMDbIDFromTVDB(ctx context.Context, tvdbID string) (string, error) {
+	logger.InfoContext(ctx, "TMDB", "Resolving TVDB ID %s", tvdbID)
+
+	tmdbID, err := fetchIdFromTMDB(ctx, c, tvdbID, "tvdb_id")
+	if err != nil {
+		return "", err
+	}
+
+	return c.FetchIMDbIDFromTMDB(ctx, "tv", tmdbID)
+}
+
+func (c *APIClient) TMDBStatus() TMDBStatus {
+	c.tmdbMu.Lock()
+	defer c.tmdbMu.Unlock()
+	return c.tmdbStatus
+}
+
+// CheckTMDB requests the API configuration, which is the cheapest call that validates the key
+func (c *APIClient) CheckTMDB(ctx context.Context) error {
+	var result map[string]any
+	err := c.fetchJSON(ctx, "tmdb", c.tmdbURL("/configuration", nil), c.TMDBAPIKey, &result)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+	if err != nil {
+		logger.WarnContext(ctx, "TMDB", "TMDB check failed: %v", err)
+	}
+
+	c.tmdbMu.Lock()
+	c.tmdbStatus = TMDBStatus{Err: err, CheckedAt: time.Now()}
+	c.tmdbMu.Unlock()
+
+	return err
+}
+
+func (c *APIClient) FetchIMDbIDFromTMDB(ctx context.Context, tmdbType, tmdbID string) (string, error) {
+	var result struct {
+		IMDbID string `json:"imdb_id"`
+	}
+	if err := c.fetchJSON(ctx, "tmdb", c.tmdbURL(fmt.Sprintf("/%s/%s/external_ids", tmdbType, tmdbID), nil), c.TMDBAPIKey, &result); err != nil {
+		return "", fmt.Errorf("failed to fetch external IDs: %w", err)
+	}
+
+	if result.IMDbID == "" {
+		return "", fmt.Errorf("%w: TMDB %s %s has no IMDb ID", ErrNoResults, tmdbType, tmdbID)
+	}
+
+	return result.IMDbID, nil
+}
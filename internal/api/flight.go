@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls with the same key into a single call
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// The call runs on its own so every caller, including the one that started it,
+// can stop waiting when its context ends without abandoning it for the others
+func (g *flightGroup[T]) Do(ctx context.Context, key string, fn func() (T, error)) (T, error, bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		call = &flightCall[T]{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			defer func() {
+				g.mu.Lock()
+				delete(g.calls, key)
+				g.mu.Unlock()
+				close(call.done)
+			}()
+			call.value, call.err = fn()
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err, shared
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err(), shared
+	}
+}
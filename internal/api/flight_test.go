@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlightGroupCoalescesCalls(t *testing.T) {
+	var group flightGroup[int]
+	var calls atomic.Int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	var result int
+	var shared bool
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		result, _, shared = group.Do(context.Background(), "tt0000001", func() (int, error) {
+			calls.Add(1)
+			close(entered)
+			<-release
+			return 42, nil
+		})
+	})
+	<-entered
+
+	// Callers that arrive while the call is held open must join it rather than start their own.
+	// Their contexts are already canceled so they return as soon as they have joined
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := range 9 {
+		_, err, joined := group.Do(canceled, "tt0000001", func() (int, error) {
+			calls.Add(1)
+			return 0, nil
+		})
+		if !joined || !errors.Is(err, context.Canceled) {
+			t.Errorf("Caller %d: expected to join the call in flight, got joined=%v err=%v", i, joined, err)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 call, got %d", calls.Load())
+	}
+	if result != 42 || shared {
+		t.Errorf("Expected the first caller to get 42 from its own call, got %d (shared=%v)", result, shared)
+	}
+}
+
+func TestFlightGroupStopsWaitingWhenCanceled(t *testing.T) {
+	var group flightGroup[int]
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err, _ := group.Do(ctx, "tt0000001", func() (int, error) {
+		<-release
+		return 42, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
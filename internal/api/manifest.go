@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+	"tweakio/internal/logger"
+)
+
+var ErrInvalidManifest = errors.New("invalid addon manifest")
+
+type Manifest struct {
+	ID          string             `json:"id"`
+	Name        string             `json:"name"`
+	Version     string             `json:"version"`
+	Description string             `json:"description"`
+	Resources   []ManifestResource `json:"resources"`
+	Types       []string           `json:"types"`
+	IDPrefixes  []string           `json:"idPrefixes"`
+}
+
+type ManifestResource struct {
+	Name       string   `json:"name"`
+	Types      []string `json:"types"`
+	IDPrefixes []string `json:"idPrefixes"`
+}
+
+type ManifestStatus struct {
+	Manifest  *Manifest
+	Err       error
+	CheckedAt time.Time
+}
+
+// Resources are either a plain name or an object that overrides the manifest's types and ID prefixes
+func (r *ManifestResource) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		r.Name = name
+		return nil
+	}
+
+	type resource ManifestResource
+	return json.Unmarshal(data, (*resource)(r))
+}
+
+func (m *Manifest) Validate() error {
+	index := slices.IndexFunc(m.Resources, func(r ManifestResource) bool { return r.Name == "stream" })
+	if index == -1 {
+		return fmt.Errorf("%w: %s does not provide streams", ErrInvalidManifest, m.Name)
+	}
+
+	types, idPrefixes := m.Types, m.IDPrefixes
+	if resource := m.Resources[index]; len(resource.Types) > 0 {
+		types, idPrefixes = resource.Types, resource.IDPrefixes
+	}
+
+	for _, mediaType := range []string{"movie", "series"} {
+		if !slices.Contains(types, mediaType) {
+			return fmt.Errorf("%w: %s does not provide %s streams", ErrInvalidManifest, m.Name, mediaType)
+		}
+	}
+
+	// Addons without ID prefixes are asked about every ID
+	if len(idPrefixes) > 0 && !slices.Contains(idPrefixes, "tt") {
+		return fmt.Errorf("%w: %s does not support IMDb IDs (tt prefix)", ErrInvalidManifest, m.Name)
+	}
+
+	return nil
+}
+
+// CheckManifest validates the manifest of every upstream of the addon. The
+// addon is usable as long as one upstream serves a valid manifest.
+func (c *APIClient) CheckManifest(ctx context.Context, addon *Addon) error {
+	status := ManifestStatus{CheckedAt: time.Now()}
+
+	var errs []error
+	for _, upstream := range addon.Upstreams {
+		manifestURL := upstream.streamURL("manifest.json")
+
+		var manifest Manifest
+		err := c.fetchJSON(ctx, addon.Name, manifestURL, "", &manifest)
+		if err == nil {
+			err = manifest.Validate()
+		}
+		// Keep the previous status when the check itself was abandoned
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			logger.WarnContext(ctx, addon.LogSource(), "Manifest check failed for %s: %v", upstream.URL.Host, err)
+			upstream.markFailure(err)
+			errs = append(errs, fmt.Errorf("%s: %w", upstream.URL.Host, err))
+			continue
+		}
+
+		logger.InfoContext(ctx, addon.LogSource(), "Manifest OK for %s: %s v%s", upstream.URL.Host, manifest.Name, manifest.Version)
+		upstream.markSuccess()
+		if status.Manifest == nil {
+			status.Manifest = &manifest
+		}
+	}
+
+	if status.Manifest == nil {
+		status.Err = errors.Join(errs...)
+	}
+
+	addon.setManifestStatus(status)
+	return status.Err
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestManifestValidate(t *testing.T) {
+	tests := map[string]struct {
+		manifest string
+		valid    bool
+	}{
+		"torrentio":       {`{"name":"Torrentio","resources":["stream"],"types":["movie","series","anime"],"idPrefixes":["tt","kitsu"]}`, true},
+		"resource object": {`{"name":"Comet","resources":[{"name":"stream","types":["movie","series"],"idPrefixes":["tt"]}],"types":["other"]}`, true},
+		"no prefixes":     {`{"name":"Generic","resources":["stream"],"types":["movie","series"]}`, true},
+		"catalog only":    {`{"name":"Cinemeta","resources":["catalog","meta"],"types":["movie","series"],"idPrefixes":["tt"]}`, false},
+		"movies only":     {`{"name":"Movies","resources":["stream"],"types":["movie"],"idPrefixes":["tt"]}`, false},
+		"anime only":      {`{"name":"Anime","resources":["stream"],"types":["movie","series"],"idPrefixes":["kitsu"]}`, false},
+	}
+
+	for name, test := range tests {
+		var manifest Manifest
+		if err := json.Unmarshal([]byte(test.manifest), &manifest); err != nil {
+			t.Errorf("%s: failed to parse manifest: %v", name, err)
+			continue
+		}
+
+		err := manifest.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected valid manifest, got %v", name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("%s: expected ErrInvalidManifest, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const maxRetryDelay = 30 * time.Second
+
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API returned an error: %s", e.Status)
+}
+
+func (c *APIClient) retryDelay(err error, attempt int) (time.Duration, bool) {
+	if attempt >= c.MaxRetries {
+		return 0, false
+	}
+
+	var statusErr *StatusError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode != http.StatusTooManyRequests && statusErr.StatusCode < 500 {
+			return 0, false
+		}
+		if statusErr.RetryAfter > 0 {
+			// Waiting longer than this would outlast the caller's patience anyway
+			return statusErr.RetryAfter, statusErr.RetryAfter <= maxRetryDelay
+		}
+	case errors.As(err, &urlErr):
+		// Network errors and timeouts
+	default:
+		return 0, false
+	}
+
+	return backoff(c.RetryBackoff, attempt), true
+}
+
+func backoff(base time.Duration, attempt int) time.Duration {
+	// Capping the shift keeps a large HTTP_MAX_RETRIES from overflowing into no delay at all
+	delay := min(base<<min(attempt, 10), maxRetryDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchJSONRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch r.URL.Path {
+		case "/flaky":
+			if attempts < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`{"ok":true}`))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &APIClient{Client: server.Client(), MaxRetries: 2}
+
+	var result struct{ OK bool }
+	if err := client.fetchJSON(context.Background(), "test", server.URL+"/flaky", "", &result); err != nil || !result.OK {
+		t.Fatalf("Expected success after retries, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	err := client.fetchJSON(context.Background(), "test", server.URL+"/missing", "", &result)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 StatusError, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected client errors not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestFetchJSONStopsWhenCanceled(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := &APIClient{Client: server.Client(), MaxRetries: 5, RetryBackoff: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var result struct{ OK bool }
+	start := time.Now()
+	err := client.fetchJSON(ctx, "test", server.URL, "", &result)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to end the request, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected fetchJSON to stop waiting for retries, took %s", elapsed)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestBackoffDoesNotOverflow(t *testing.T) {
+	for _, attempt := range []int{0, 10, 35, 64, 1000} {
+		if delay := backoff(500*time.Millisecond, attempt); delay <= 0 || delay > maxRetryDelay {
+			t.Errorf("Attempt %d: expected a delay up to %s, got %s", attempt, maxRetryDelay, delay)
+		}
+	}
+}
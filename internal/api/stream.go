@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"tweakio/internal/logger"
+	"tweakio/internal/metrics"
+)
+
+// Stream is a single entry of a Stremio /stream response
+type Stream struct {
+	Name          string        `json:"name"`
+	Title         string        `json:"title"`
+	Description   string        `json:"description"`
+	InfoHash      string        `json:"infoHash"`
+	FileIdx       *int          `json:"fileIdx"`
+	Sources       []string      `json:"sources"`
+	BehaviorHints BehaviorHints `json:"behaviorHints"`
+}
+
+type BehaviorHints struct {
+	Filename   string `json:"filename"`
+	BingeGroup string `json:"bingeGroup"`
+	VideoSize  int64  `json:"videoSize"`
+}
+
+// Streams are decoded one at a time so a malformed entry, or one without an
+// infoHash such as a debrid URL stream, is skipped instead of failing the response
+func decodeStreams(ctx context.Context, addon *Addon, raw []json.RawMessage) []Stream {
+	streams := make([]Stream, 0, len(raw))
+	skipped := 0
+	for _, data := range raw {
+		var stream Stream
+		if err := json.Unmarshal(data, &stream); err != nil || stream.InfoHash == "" {
+			skipped++
+			continue
+		}
+		streams = append(streams, stream)
+	}
+
+	if skipped > 0 {
+		metrics.SkippedStreams.Add(float64(skipped), addon.Name)
+		logger.DebugContext(ctx, addon.LogSource(), "Skipped %d malformed streams or streams without an infoHash", skipped)
+	}
+	return streams
+}
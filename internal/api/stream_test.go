@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func TestDecodeStreams(t *testing.T) {
+	var raw []json.RawMessage
+	err := json.Unmarshal([]byte(`[
+		{"title":"Chungus","infoHash":"abc","fileIdx":0,"sources":["tracker:udp://tracker.example:1337"],"behaviorHints":{"filename":"Chungus.mkv","bingeGroup":"torrentio|1080p","videoSize":1073741824}},
+		{"title":"Chungus","url":"https://debrid.example/chungus.mkv"},
+		{"title":"Chungus","infoHash":42},
+		{"title":"Chungus","infoHash":"def"}
+	]`), &raw)
+	if err != nil {
+		t.Fatalf("Failed to prepare streams: %v", err)
+	}
+
+	addonURL, _ := url.Parse("https://torrentio.example/")
+	streams := decodeStreams(context.Background(), NewAddon("torrentio", "torrentio", []*url.URL{addonURL}, false), raw)
+	if len(streams) != 2 {
+		t.Fatalf("Expected 2 streams with an infoHash, got %d", len(streams))
+	}
+
+	stream := streams[0]
+	if stream.InfoHash != "abc" || stream.FileIdx == nil || *stream.FileIdx != 0 || len(stream.Sources) != 1 {
+		t.Errorf("Unexpected stream: %+v", stream)
+	}
+	if hints := stream.BehaviorHints; hints.Filename != "Chungus.mkv" || hints.BingeGroup != "torrentio|1080p" || hints.VideoSize != 1073741824 {
+		t.Errorf("Unexpected behavior hints: %+v", hints)
+	}
+}
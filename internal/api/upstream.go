@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamCooldown    = 30 * time.Second
+	maxUpstreamCooldown = 10 * time.Minute
+)
+
+type Upstream struct {
+	URL *url.URL
+
+	mu             sync.Mutex
+	failures       int
+	unhealthyUntil time.Time
+	lastError      error
+}
+
+func NewUpstreams(urls []*url.URL) []*Upstream {
+	upstreams := make([]*Upstream, len(urls))
+	for i, u := range urls {
+		upstreams[i] = &Upstream{URL: u}
+	}
+	return upstreams
+}
+
+func (u *Upstream) streamURL(streamPath string) string {
+	streamURL := *u.URL
+	streamURL.Path = path.Join(streamURL.Path, streamPath)
+	return streamURL.String()
+}
+
+func (u *Upstream) Healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().After(u.unhealthyUntil)
+}
+
+func (u *Upstream) LastError() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lastError
+}
+
+func (u *Upstream) markSuccess() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+	u.unhealthyUntil = time.Time{}
+	u.lastError = nil
+}
+
+// Each consecutive failure doubles how long the upstream is skipped for
+func (u *Upstream) markFailure(err error) time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cooldown := min(upstreamCooldown<<min(u.failures, 10), maxUpstreamCooldown)
+	u.failures++
+	u.unhealthyUntil = time.Now().Add(cooldown)
+	u.lastError = err
+	return cooldown
+}
+
+// Healthy upstreams keep their configured order and unhealthy ones are kept
+// at the end as a last resort
+func orderUpstreams(upstreams []*Upstream) []*Upstream {
+	var healthy, unhealthy []*Upstream
+	for _, u := range upstreams {
+		if u.Healthy() {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func mergeStreams(responses [][]Stream) []Stream {
+	var streams []Stream
+	seen := make(map[string]bool)
+	for _, response := range responses {
+		for _, stream := range response {
+			infoHash := strings.ToLower(stream.InfoHash)
+			if infoHash != "" {
+				if seen[infoHash] {
+					continue
+				}
+				seen[infoHash] = true
+			}
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
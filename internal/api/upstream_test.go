@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFetchFromTorrentioFailover(t *testing.T) {
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer blocked.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"streams":[{"title":"Chungus","infoHash":"abc"}]}`))
+	}))
+	defer mirror.Close()
+
+	blockedURL, _ := url.Parse(blocked.URL + "/")
+	mirrorURL, _ := url.Parse(mirror.URL + "/")
+	addon := NewAddon("torrentio", "torrentio", []*url.URL{blockedURL, mirrorURL}, false)
+	client := &APIClient{Addons: []*Addon{addon}, Client: http.DefaultClient}
+
+	streams, err := client.FetchFromAddon(context.Background(), addon, "movie", "tt0000001", 0, 0)
+	if err != nil || len(streams) != 1 {
+		t.Fatalf("Expected 1 stream from the mirror, got %d (err=%v)", len(streams), err)
+	}
+	if addon.Upstreams[0].Healthy() {
+		t.Errorf("Expected the blocked upstream to be marked unhealthy")
+	}
+	if !addon.Upstreams[1].Healthy() {
+		t.Errorf("Expected the mirror to stay healthy")
+	}
+
+	addon.FanOut = true
+	addon.Upstreams[0].markSuccess()
+	streams, err = client.FetchFromAddon(context.Background(), addon, "movie", "tt0000001", 0, 0)
+	if err != nil || len(streams) != 1 {
+		t.Fatalf("Expected fan-out to return the mirror's stream, got %d (err=%v)", len(streams), err)
+	}
+}
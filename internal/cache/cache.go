@@ -2,26 +2,56 @@ package cache
 
 import (
 	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
+	"tweakio/internal/metrics"
 )
 
+const episodeCacheVersion = 2
+
 type EpisodeCache struct {
-	mu       sync.Mutex
-	maxSize  int
-	cache    map[string]*list.Element
-	eviction *list.List
+	mu        sync.Mutex
+	maxSize   int
+	ttl       time.Duration
+	airingTTL time.Duration
+	cache     map[string]*list.Element
+	eviction  *list.List
+	dirty     bool
 }
 
 type entry struct {
 	key   string
-	value map[int]int
+	value map[int]seasonEntry
+}
+
+type seasonEntry struct {
+	Episodes  int       `json:"episodes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type episodeCacheFile struct {
+	Version int                `json:"version"`
+	Entries []episodeCacheItem `json:"entries"`
+}
+
+type episodeCacheItem struct {
+	IMDbID  string              `json:"imdb_id"`
+	Seasons map[int]seasonEntry `json:"seasons"`
 }
 
-func CreateEpisodeCache(maxSize int) *EpisodeCache {
+func CreateEpisodeCache(maxSize int, ttl, airingTTL time.Duration) *EpisodeCache {
 	return &EpisodeCache{
-		maxSize:  maxSize,
-		cache:    make(map[string]*list.Element),
-		eviction: list.New(),
+		maxSize:   maxSize,
+		ttl:       ttl,
+		airingTTL: airingTTL,
+		cache:     make(map[string]*list.Element),
+		eviction:  list.New(),
 	}
 }
 
@@ -32,18 +62,36 @@ func (c *EpisodeCache) Get(imdbID string, season int) (int, bool) {
 	if elem, found := c.cache[imdbID]; found {
 		c.eviction.MoveToFront(elem)
 		seasons := elem.Value.(*entry).value
-		episodeCount, exists := seasons[season]
-		return episodeCount, exists
+		cached, exists := seasons[season]
+		if exists && time.Now().After(cached.ExpiresAt) {
+			delete(seasons, season)
+			c.dirty = true
+			exists = false
+		}
+		if exists {
+			metrics.CacheLookups.Inc("episodes", "hit")
+			return cached.Episodes, true
+		}
 	}
+	metrics.CacheLookups.Inc("episodes", "miss")
 	return 0, false
 }
 
-func (c *EpisodeCache) Set(imdbID string, season, episodeCount int) {
+// Seasons that are still airing expire sooner so their episode count catches up with TMDB
+func (c *EpisodeCache) Set(imdbID string, season, episodeCount int, airing bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	ttl := c.ttl
+	if airing {
+		ttl = c.airingTTL
+	}
+	seasonData := seasonEntry{Episodes: episodeCount, ExpiresAt: time.Now().Add(ttl)}
+
+	c.dirty = true
+
 	if elem, found := c.cache[imdbID]; found {
-		elem.Value.(*entry).value[season] = episodeCount
+		elem.Value.(*entry).value[season] = seasonData
 		c.eviction.MoveToFront(elem)
 		return
 	}
@@ -53,13 +101,130 @@ func (c *EpisodeCache) Set(imdbID string, season, episodeCount int) {
 		if oldest != nil {
 			delete(c.cache, oldest.Value.(*entry).key)
 			c.eviction.Remove(oldest)
+			metrics.CacheEvictions.Inc("episodes")
 		}
 	}
 
 	newEntry := &entry{
 		key:   imdbID,
-		value: map[int]int{season: episodeCount},
+		value: map[int]seasonEntry{season: seasonData},
 	}
 	elem := c.eviction.PushFront(newEntry)
 	c.cache[imdbID] = elem
 }
+
+func (c *EpisodeCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.cache)
+}
+
+func (c *EpisodeCache) Load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cache file: %w", err)
+	}
+
+	var file episodeCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("failed to parse cache file: %w", err)
+	}
+	if file.Version != episodeCacheVersion {
+		return 0, fmt.Errorf("unsupported cache file version %d", file.Version)
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Entries are saved most recently used first, so push them in reverse
+	for i := len(file.Entries) - 1; i >= 0; i-- {
+		item := file.Entries[i]
+		// Skip damaged entries rather than rejecting the whole file
+		if item.IMDbID == "" {
+			continue
+		}
+		maps.DeleteFunc(item.Seasons, func(_ int, cached seasonEntry) bool {
+			return now.After(cached.ExpiresAt)
+		})
+		if len(item.Seasons) == 0 {
+			continue
+		}
+		if _, found := c.cache[item.IMDbID]; found {
+			continue
+		}
+
+		if len(c.cache) >= c.maxSize {
+			oldest := c.eviction.Back()
+			if oldest == nil {
+				break
+			}
+			delete(c.cache, oldest.Value.(*entry).key)
+			c.eviction.Remove(oldest)
+		}
+
+		elem := c.eviction.PushFront(&entry{key: item.IMDbID, value: item.Seasons})
+		c.cache[item.IMDbID] = elem
+	}
+
+	return len(c.cache), nil
+}
+
+func (c *EpisodeCache) Save(path string) error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+
+	file := episodeCacheFile{Version: episodeCacheVersion}
+	for elem := c.eviction.Front(); elem != nil; elem = elem.Next() {
+		cached := elem.Value.(*entry)
+		if len(cached.value) == 0 {
+			continue
+		}
+		file.Entries = append(file.Entries, episodeCacheItem{IMDbID: cached.key, Seasons: maps.Clone(cached.value)})
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(file)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// Writing to a temporary file first means a crash mid-write leaves the previous copy intact
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache file: %w", err)
+	}
+
+	return nil
+}
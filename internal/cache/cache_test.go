@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEpisodeCachePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "episodes.json")
+
+	c := CreateEpisodeCache(10, time.Hour, time.Hour)
+	c.Set("tt0000001", 1, 10, false)
+	c.Set("tt0000001", 2, 8, true)
+	c.Set("tt0000002", 1, 6, false)
+	if err := c.Save(path); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+
+	restored := CreateEpisodeCache(10, time.Hour, time.Hour)
+	if loaded, err := restored.Load(path); err != nil || loaded != 2 {
+		t.Fatalf("Expected 2 shows loaded, got %d (err=%v)", loaded, err)
+	}
+	if episodes, found := restored.Get("tt0000001", 2); !found || episodes != 8 {
+		t.Errorf("Expected 8 episodes for season 2, got %d (found=%v)", episodes, found)
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateEpisodeCache(10, time.Hour, time.Hour).Load(path); err == nil {
+		t.Errorf("Expected an error for a corrupt cache file")
+	}
+
+	if loaded, err := CreateEpisodeCache(10, time.Hour, time.Hour).Load(filepath.Join(t.TempDir(), "missing.json")); err != nil || loaded != 0 {
+		t.Errorf("Expected a missing file to load nothing, got %d (err=%v)", loaded, err)
+	}
+}
+
+func TestEpisodeCacheExpiry(t *testing.T) {
+	c := CreateEpisodeCache(10, time.Hour, time.Millisecond)
+	c.Set("tt0000001", 1, 10, false)
+	c.Set("tt0000001", 2, 3, true)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := c.Get("tt0000001", 1); !found {
+		t.Errorf("Expected finished season to still be cached")
+	}
+	if _, found := c.Get("tt0000001", 2); found {
+		t.Errorf("Expected airing season to expire")
+	}
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"tweakio/internal/metrics"
+)
+
+type IDCache struct {
+	mu       sync.Mutex
+	maxSize  int
+	cache    map[string]*list.Element
+	eviction *list.List
+}
+
+type idEntry struct {
+	key    string
+	imdbID string
+}
+
+func CreateIDCache(maxSize int) *IDCache {
+	return &IDCache{
+		maxSize:  maxSize,
+		cache:    make(map[string]*list.Element),
+		eviction: list.New(),
+	}
+}
+
+func (c *IDCache) Get(source, id string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.cache[source+":"+id]; found {
+		c.eviction.MoveToFront(elem)
+		metrics.CacheLookups.Inc("ids", "hit")
+		return elem.Value.(*idEntry).imdbID, true
+	}
+	metrics.CacheLookups.Inc("ids", "miss")
+	return "", false
+}
+
+func (c *IDCache) Set(source, id, imdbID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := source + ":" + id
+	if elem, found := c.cache[key]; found {
+		elem.Value.(*idEntry).imdbID = imdbID
+		c.eviction.MoveToFront(elem)
+		return
+	}
+
+	if len(c.cache) >= c.maxSize {
+		oldest := c.eviction.Back()
+		if oldest != nil {
+			delete(c.cache, oldest.Value.(*idEntry).key)
+			c.eviction.Remove(oldest)
+			metrics.CacheEvictions.Inc("ids")
+		}
+	}
+
+	elem := c.eviction.PushFront(&idEntry{key: key, imdbID: imdbID})
+	c.cache[key] = elem
+}
+
+func (c *IDCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.cache)
+}
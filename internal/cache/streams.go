@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"tweakio/internal/metrics"
+)
+
+// Streams are stored as returned by the addon, T being the decoded stream type
+type StreamCache[T any] struct {
+	mu       sync.Mutex
+	maxSize  int
+	ttl      time.Duration
+	emptyTTL time.Duration
+	cache    map[string]*list.Element
+	eviction *list.List
+}
+
+type streamEntry[T any] struct {
+	key       string
+	streams   []T
+	expiresAt time.Time
+}
+
+func CreateStreamCache[T any](maxSize int, ttl, emptyTTL time.Duration) *StreamCache[T] {
+	return &StreamCache[T]{
+		maxSize:  maxSize,
+		ttl:      ttl,
+		emptyTTL: emptyTTL,
+		cache:    make(map[string]*list.Element),
+		eviction: list.New(),
+	}
+}
+
+func (c *StreamCache[T]) Get(key string) ([]T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.cache[key]
+	if !found {
+		metrics.CacheLookups.Inc("streams", "miss")
+		return nil, false
+	}
+
+	cached := elem.Value.(*streamEntry[T])
+	if time.Now().After(cached.expiresAt) {
+		delete(c.cache, key)
+		c.eviction.Remove(elem)
+		metrics.CacheLookups.Inc("streams", "miss")
+		return nil, false
+	}
+
+	c.eviction.MoveToFront(elem)
+	metrics.CacheLookups.Inc("streams", "hit")
+	return cached.streams, true
+}
+
+func (c *StreamCache[T]) Set(key string, streams []T) {
+	ttl := c.ttl
+	if len(streams) == 0 {
+		ttl = c.emptyTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+	if elem, found := c.cache[key]; found {
+		cached := elem.Value.(*streamEntry[T])
+		cached.streams = streams
+		cached.expiresAt = expiresAt
+		c.eviction.MoveToFront(elem)
+		return
+	}
+
+	if len(c.cache) >= c.maxSize {
+		oldest := c.eviction.Back()
+		if oldest != nil {
+			delete(c.cache, oldest.Value.(*streamEntry[T]).key)
+			c.eviction.Remove(oldest)
+			metrics.CacheEvictions.Inc("streams")
+		}
+	}
+
+	elem := c.eviction.PushFront(&streamEntry[T]{key: key, streams: streams, expiresAt: expiresAt})
+	c.cache[key] = elem
+}
+
+func (c *StreamCache[T]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.cache)
+}
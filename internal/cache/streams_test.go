@@ -0,0 +1,27 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamCache(t *testing.T) {
+	c := CreateStreamCache[string](2, time.Hour, time.Millisecond)
+
+	c.Set("a", []string{"stream"})
+	c.Set("empty", nil)
+	if streams, found := c.Get("a"); !found || len(streams) != 1 {
+		t.Errorf("Expected cached streams for 'a', got %v (found=%v)", streams, found)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if _, found := c.Get("empty"); found {
+		t.Errorf("Expected empty result to expire")
+	}
+
+	c.Set("b", []string{"stream"})
+	c.Set("c", []string{"stream"})
+	if _, found := c.Get("a"); found {
+		t.Errorf("Expected 'a' to be evicted")
+	}
+}
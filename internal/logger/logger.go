@@ -1,36 +1,120 @@
 package logger
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"time"
+	"regexp"
 )
 
-var DebugEnabled bool
+type requestIDKey struct{}
 
-func timestamp() string {
-	return time.Now().Format("2006-01-02 15:04:05")
+var (
+	level  = new(slog.LevelVar)
+	stdout = newLogger("text", os.Stdout)
+	stderr = newLogger("text", os.Stderr)
+)
+
+// Secrets that end up in logged URLs and errors: proxy credentials, API keys in
+// query strings, debrid keys in Torrentio options and base64 addon configs or JWTs
+var redactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(://)[^/@\s]+@`), "${1}REDACTED@"},
+	{regexp.MustCompile(`(?i)\b(api_?key|access_token|token)=[^&\s"]+`), "${1}=REDACTED"},
+	{regexp.MustCompile(`(?i)\b(realdebrid|premiumize|alldebrid|debridlink|easydebrid|offcloud|torbox|putio)=[^|/\s%"]+`), "${1}=REDACTED"},
+	{regexp.MustCompile(`(?i)(Bearer\s+)\S+`), "${1}REDACTED"},
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_=+.-]+`), "REDACTED"},
+}
+
+func newLogger(format string, w io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+func Configure(format, levelName string) error {
+	if format != "text" && format != "json" {
+		return errors.New("LOG_FORMAT must be text or json")
+	}
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(levelName)); err != nil {
+		return errors.New("LOG_LEVEL must be debug, info, warn or error")
+	}
+
+	level.Set(l)
+	stdout = newLogger(format, os.Stdout)
+	stderr = newLogger(format, os.Stderr)
+	return nil
+}
+
+func DebugEnabled() bool {
+	return level.Level() <= slog.LevelDebug
+}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+func log(ctx context.Context, l *slog.Logger, lvl slog.Level, source, message string, args ...any) {
+	if !l.Enabled(ctx, lvl) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.String("source", source)}
+	if requestID := RequestID(ctx); requestID != "" {
+		attrs = append(attrs, slog.String("request_id", requestID))
+	}
+	l.LogAttrs(ctx, lvl, Redact(fmt.Sprintf(message, args...)), attrs...)
 }
 
 func Info(source, message string, args ...any) {
-	msg := fmt.Sprintf(message, args...)
-	fmt.Fprintf(os.Stdout, "%s [%s] %s\n", timestamp(), source, msg)
+	log(context.Background(), stdout, slog.LevelInfo, source, message, args...)
 }
 
 func Warn(source, message string, args ...any) {
-	msg := fmt.Sprintf(message, args...)
-	fmt.Fprintf(os.Stderr, "%s [%s] ⚠️ %s\n", timestamp(), source, msg)
+	log(context.Background(), stderr, slog.LevelWarn, source, message, args...)
 }
 
 func Error(source, message string, args ...any) {
-	msg := fmt.Sprintf(message, args...)
-	fmt.Fprintf(os.Stderr, "%s [%s] ❌ %s\n", timestamp(), source, msg)
+	log(context.Background(), stderr, slog.LevelError, source, message, args...)
 }
 
 func Debug(source, message string, args ...any) {
-	if !DebugEnabled {
-		return
-	}
-	msg := fmt.Sprintf(message, args...)
-	fmt.Fprintf(os.Stdout, "%s [%s] 🔍 %s\n", timestamp(), source, msg)
+	log(context.Background(), stdout, slog.LevelDebug, source, message, args...)
+}
+
+func InfoContext(ctx context.Context, source, message string, args ...any) {
+	log(ctx, stdout, slog.LevelInfo, source, message, args...)
+}
+
+func WarnContext(ctx context.Context, source, message string, args ...any) {
+	log(ctx, stderr, slog.LevelWarn, source, message, args...)
+}
+
+func ErrorContext(ctx context.Context, source, message string, args ...any) {
+	log(ctx, stderr, slog.LevelError, source, message, args...)
+}
+
+func DebugContext(ctx context.Context, source, message string, args ...any) {
+	log(ctx, stdout, slog.LevelDebug, source, message, args...)
 }
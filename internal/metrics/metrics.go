@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	Requests         = NewCounterVec("tweakio_requests_total", "Torznab requests by search type and outcome.", "type", "outcome")
+	SearchResults    = NewHistogramVec("tweakio_search_results", "Results returned per search before pagination.", []float64{0, 1, 5, 10, 25, 50, 100, 250, 500}, "type")
+	UpstreamDuration = NewHistogramVec("tweakio_upstream_request_duration_seconds", "Duration of requests to addons and TMDB, including failed attempts.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "upstream")
+	UpstreamRetries  = NewCounterVec("tweakio_upstream_retries_total", "Requests to addons and TMDB that were retried.", "upstream")
+	UpstreamFailures = NewCounterVec("tweakio_upstream_failures_total", "Requests to addons and TMDB that failed after all retries.", "upstream")
+	CacheLookups     = NewCounterVec("tweakio_cache_lookups_total", "Cache lookups by cache and result.", "cache", "result")
+	CacheEvictions   = NewCounterVec("tweakio_cache_evictions_total", "Entries evicted from a full cache.", "cache")
+	ParseFailures    = NewCounterVec("tweakio_parse_failures_total", "Streams that could not be parsed, by addon.", "addon")
+	SkippedStreams   = NewCounterVec("tweakio_skipped_streams_total", "Malformed streams or streams without an infoHash, by addon.", "addon")
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels map[string]string
+	fn     func() float64
+}
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	key := seriesKey(c.labels, labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := seriesKey(h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, found := h.values[key]
+	if !found {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range slices.Sorted(maps.Keys(h.values)) {
+		series := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, key, formatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, key, "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, key, ""), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, key, ""), series.count)
+	}
+}
+
+// Gauges are read when scraped, so values such as cache sizes don't need to be kept in sync
+func NewGaugeFunc(name, help string, labels map[string]string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	g.writeSample(w)
+}
+
+func (g *GaugeFunc) writeSample(w io.Writer) {
+	names := slices.Sorted(maps.Keys(g.labels))
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = g.labels[name]
+	}
+	fmt.Fprintf(w, "%s%s %s\n", g.name, labelString(names, seriesKey(names, values), ""), formatValue(g.fn()))
+}
+
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	collectors := slices.Clone(registry)
+	registryMu.Unlock()
+
+	// Gauges sharing a name are registered separately but must be written together
+	written := make(map[string]bool)
+	for _, c := range collectors {
+		g, ok := c.(*GaugeFunc)
+		if !ok {
+			c.write(w)
+			continue
+		}
+		if written[g.name] {
+			continue
+		}
+		written[g.name] = true
+
+		g.write(w)
+		for _, other := range collectors {
+			if other, ok := other.(*GaugeFunc); ok && other != g && other.name == g.name {
+				other.writeSample(w)
+			}
+		}
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+func seriesKey(labels, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func labelString(labels []string, key, le string) string {
+	var parts []string
+	if len(labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			parts = append(parts, labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
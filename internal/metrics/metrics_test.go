@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Test requests.", "type")
+	counter.Inc("movie")
+	counter.Add(2, `tv"search`)
+
+	histogram := NewHistogramVec("test_duration_seconds", "Test durations.", []float64{0.5, 1}, "upstream")
+	histogram.Observe(0.75, "tmdb")
+
+	NewGaugeFunc("test_entries", "Test entries.", map[string]string{"cache": "a"}, func() float64 { return 3 })
+	NewGaugeFunc("test_entries", "Test entries.", map[string]string{"cache": "b"}, func() float64 { return 4 })
+
+	var output strings.Builder
+	WriteTo(&output)
+
+	for _, expected := range []string{
+		"# TYPE test_requests_total counter\ntest_requests_total{type=\"movie\"} 1\ntest_requests_total{type=\"tv\\\"search\"} 2\n",
+		"test_duration_seconds_bucket{upstream=\"tmdb\",le=\"0.5\"} 0\n",
+		"test_duration_seconds_bucket{upstream=\"tmdb\",le=\"1\"} 1\n",
+		"test_duration_seconds_bucket{upstream=\"tmdb\",le=\"+Inf\"} 1\n",
+		"test_duration_seconds_sum{upstream=\"tmdb\"} 0.75\ntest_duration_seconds_count{upstream=\"tmdb\"} 1\n",
+		"# TYPE test_entries gauge\ntest_entries{cache=\"a\"} 3\ntest_entries{cache=\"b\"} 4\n",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Expected output to contain:\n%s\ngot:\n%s", expected, output.String())
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package parser
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 	"tweakio/internal/api"
 	"tweakio/internal/cache"
 	"tweakio/internal/logger"
+	"unicode"
 )
 
 var Regexes *RegexPatterns
@@ -20,16 +25,93 @@ type RegexPatterns struct {
 	EpisodeRange  *regexp.Regexp
 	Episode       *regexp.Regexp
 	Info          *regexp.Regexp
+	Resolution    *regexp.Regexp
+	Year          *regexp.Regexp
+	Seeders       *regexp.Regexp
+	Source        *regexp.Regexp
+	VideoCodec    *regexp.Regexp
+	AudioCodec    *regexp.Regexp
+	Language      *regexp.Regexp
+	Flag          *regexp.Regexp
+}
+
+type streamFormat struct {
+	parse func(ctx context.Context, stream api.Stream) (*TorrentioResult, error)
+	// Torrentio reports the size of the requested episode rather than the whole pack
+	episodeSize bool
+}
+
+var streamFormats = map[string]streamFormat{
+	"torrentio":     {parse: parseTorrentioStream, episodeSize: true},
+	"knightcrawler": {parse: parseTorrentioStream, episodeSize: true},
+	"mediafusion":   {parse: parseGenericStream},
+	"comet":         {parse: parseGenericStream},
+	"generic":       {parse: parseGenericStream},
+}
+
+var subcategories = map[int]map[string]int{
+	2000: {"HD": 2010, "SD": 2020, "UHD": 2030},
+	5000: {"HD": 5030, "SD": 5040, "UHD": 5050},
 }
 
 type TorrentioResult struct {
-	Title    string
-	Link     string
-	Size     float64
-	InfoHash string
-	Peers    int
-	Category int
-	Source   string
+	Title      string
+	Link       string
+	Size       float64
+	InfoHash   string
+	Peers      int
+	Category   int
+	Resolution string
+	VideoCodec string
+	AudioCodec string
+	Languages  []string
+	Season     int
+	Episode    int
+	Files      int
+	Source     string
+	Trackers   []string
+	SeasonPack bool
+}
+
+var videoCodecs = map[string]string{
+	"x264": "x264", "h264": "x264", "h.264": "x264", "avc": "x264",
+	"x265": "x265", "h265": "x265", "h.265": "x265", "hevc": "x265",
+	"av1": "AV1", "vp9": "VP9", "xvid": "XviD", "divx": "DivX",
+}
+
+var audioCodecs = map[string]string{
+	"ddp": "EAC3", "dd+": "EAC3", "eac3": "EAC3", "e-ac3": "EAC3", "eac-3": "EAC3", "e-ac-3": "EAC3",
+	"dd": "AC3", "ac3": "AC3", "aac": "AAC", "dts": "DTS", "dts-hd": "DTS-HD", "dts-x": "DTS-X",
+	"truehd": "TrueHD", "atmos": "Atmos", "flac": "FLAC", "opus": "Opus", "mp3": "MP3",
+}
+
+var titleLanguages = map[string]string{
+	"ita": "Italian", "italian": "Italian", "french": "French", "vff": "French", "truefrench": "French",
+	"german": "German", "spanish": "Spanish", "castellano": "Spanish", "latino": "Spanish",
+	"rus": "Russian", "russian": "Russian", "hindi": "Hindi", "japanese": "Japanese", "korean": "Korean",
+}
+
+// Keyed by the country code spelled out by a flag emoji
+var flagLanguages = map[string]string{
+	"gb": "English", "us": "English", "it": "Italian", "fr": "French", "de": "German",
+	"es": "Spanish", "mx": "Spanish", "ru": "Russian", "pt": "Portuguese", "br": "Portuguese",
+	"jp": "Japanese", "kr": "Korean", "cn": "Chinese", "tw": "Chinese", "in": "Hindi",
+	"nl": "Dutch", "pl": "Polish", "tr": "Turkish", "ua": "Ukrainian", "cz": "Czech",
+	"hu": "Hungarian", "se": "Swedish", "dk": "Danish", "no": "Norwegian", "fi": "Finnish",
+	"gr": "Greek", "il": "Hebrew", "sa": "Arabic", "th": "Thai", "vn": "Vietnamese", "ro": "Romanian",
+}
+
+type Options struct {
+	Format string
+	// Scale sizes of season packs by their episode count, since some addons only report one episode
+	EstimatePackSize bool
+}
+
+type SearchQuery struct {
+	Title   string
+	Year    int
+	Season  int
+	Episode int
 }
 
 func CompileRegex() error {
@@ -54,129 +136,302 @@ func CompileRegex() error {
 	if regexes.Info, err = regexp.Compile("👤\\s*(\\d+)\\s*💾\\s*([\\d.]+)\\s*(GB|MB)\\s*⚙️\\s*(.+)"); err != nil {
 		return err
 	}
+	if regexes.Size, err = regexp.Compile("💾\\s*([\\d.]+)\\s*(TB|GB|MB)"); err != nil {
+		return err
+	}
+	if regexes.Seeders, err = regexp.Compile("👤\\s*(\\d+)"); err != nil {
+		return err
+	}
+	if regexes.Source, err = regexp.Compile("(?:⚙️|🔗|🔎|🌐)\\s*([^\\n]+)"); err != nil {
+		return err
+	}
+	if regexes.VideoCodec, err = regexp.Compile("(?i)\\b(x26[45]|h\\.?26[45]|avc|hevc|av1|vp9|xvid|divx)\\b"); err != nil {
+		return err
+	}
+	if regexes.AudioCodec, err = regexp.Compile("(?i)\\b(ddp|dd\\+|e-?ac-?3|dd|ac3|aac|dts-hd|dts-x|dts|truehd|atmos|flac|opus|mp3)(?:\\b|[\\d.])"); err != nil {
+		return err
+	}
+	if regexes.Language, err = regexp.Compile("(?i)\\b(ita|italian|french|vff|truefrench|german|spanish|castellano|latino|rus|russian|hindi|japanese|korean)\\b"); err != nil {
+		return err
+	}
+	// Torrentio lists audio languages as flag emoji, which are pairs of regional indicator symbols
+	if regexes.Flag, err = regexp.Compile("([\\x{1F1E6}-\\x{1F1FF}]{2})"); err != nil {
+		return err
+	}
+	if regexes.Year, err = regexp.Compile("\\b((?:19|20)\\d{2})\\b"); err != nil {
+		return err
+	}
+	if regexes.Resolution, err = regexp.Compile("(?i)\\b(2160p|4k|uhd|1440p|1080p|720p|576p|480p|360p)\\b"); err != nil {
+		return err
+	}
 
 	Regexes = regexes
 	return nil
 }
 
-func ParseResult(result any, mediaType, imdbID string, httpClient *api.APIClient, episodeCache *cache.EpisodeCache) (*TorrentioResult, error) {
-	parsedResult, ok := result.(map[string]any)
-	if !ok {
-		return nil, errors.New("invalid result format")
-	}
+func SupportedFormat(format string) bool {
+	_, ok := streamFormats[format]
+	return ok
+}
 
-	title, ok := parsedResult["title"].(string)
+func ParseResult(ctx context.Context, stream api.Stream, options Options, mediaType, imdbID string, httpClient *api.APIClient, episodeCache *cache.EpisodeCache) (*TorrentioResult, error) {
+	streamFormat, ok := streamFormats[options.Format]
 	if !ok {
-		return nil, errors.New("missing title from result")
+		return nil, fmt.Errorf("unsupported stream format %s", options.Format)
 	}
+	estimatePackSize := options.EstimatePackSize && streamFormat.episodeSize
 
-	logger.Debug("PARSER", "Processing result: title=%s, infoHash=%v", title, parsedResult["infoHash"])
+	torrentioResult, err := streamFormat.parse(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+	cleanTitle := torrentioResult.Title
 
-	cleanTitle := getCleanTitle(title)
+	// Some addons only report the file size in the behavior hints
+	if torrentioResult.Size == 0 && stream.BehaviorHints.VideoSize > 0 {
+		torrentioResult.Size = float64(stream.BehaviorHints.VideoSize) / (1024 * 1024 * 1024)
+	}
 
-	torrentioResult := &TorrentioResult{
-		Title:    cleanTitle,
-		InfoHash: parsedResult["infoHash"].(string),
-		Category: 5000,
+	torrentioResult.Resolution = getResolution(cleanTitle)
+	if torrentioResult.Resolution == "" {
+		// Torrentio puts the quality in the stream name, e.g. "Torrentio\n4k"
+		torrentioResult.Resolution = getResolution(stream.Name)
 	}
 
-	parseInfo(title, torrentioResult)
+	torrentioResult.VideoCodec = getVideoCodec(cleanTitle)
+	torrentioResult.AudioCodec = getAudioCodec(cleanTitle)
+	torrentioResult.Languages = getLanguages(cleanTitle, stream.Title+"\n"+stream.Description)
+	torrentioResult.Trackers = getTrackers(stream.Sources)
 
 	if mediaType != "tvsearch" {
-		torrentioResult.Category = 2000
+		torrentioResult.Category = getCategory(2000, torrentioResult.Resolution)
 		return torrentioResult, nil
 	}
+	torrentioResult.Category = getCategory(5000, torrentioResult.Resolution)
 
 	if start, end, found := getSeasonRange(cleanTitle); found {
-		logger.Debug("PARSER", "Found season range in title '%s': start=%d, end=%d", cleanTitle, start, end)
-		episodes := GetOrFetchEpisodes(imdbID, start, end, httpClient, episodeCache)
-		torrentioResult.Size *= float64(episodes)
+		logger.DebugContext(ctx, "PARSER", "Found season range in title '%s': start=%d, end=%d", cleanTitle, start, end)
+		setPackEpisodes(ctx, torrentioResult, estimatePackSize, imdbID, start, end, httpClient, episodeCache)
+		torrentioResult.SeasonPack = true
 		return torrentioResult, nil
 	}
 	if season, found := getSeasonNumber(cleanTitle); found {
-		logger.Debug("PARSER", "Found season number in title '%s': season=%d", cleanTitle, season)
-		episodes := GetOrFetchEpisodes(imdbID, season, season, httpClient, episodeCache)
-		torrentioResult.Size *= float64(episodes)
+		logger.DebugContext(ctx, "PARSER", "Found season number in title '%s': season=%d", cleanTitle, season)
+		setPackEpisodes(ctx, torrentioResult, estimatePackSize, imdbID, season, season, httpClient, episodeCache)
+		torrentioResult.Season = season
+		torrentioResult.SeasonPack = true
 		return torrentioResult, nil
 	}
 	if start, end, found := getEpisodeRange(cleanTitle); found {
-		logger.Debug("PARSER", "Found episode range in title '%s': start=%d, end=%d", cleanTitle, start, end)
-		episodes := end - start + 1
-		torrentioResult.Size *= float64(episodes)
+		logger.DebugContext(ctx, "PARSER", "Found episode range in title '%s': start=%d, end=%d", cleanTitle, start, end)
+		if estimatePackSize {
+			episodes := end - start + 1
+			torrentioResult.Size *= float64(episodes)
+		}
+		torrentioResult.Season, _ = getSingleEpisode(cleanTitle)
+		torrentioResult.Files = end - start + 1
+		return torrentioResult, nil
+	}
+	if season, episode := getSingleEpisode(cleanTitle); season > 0 {
+		logger.DebugContext(ctx, "PARSER", "Found episode in title '%s': season=%d, episode=%d", cleanTitle, season, episode)
+		torrentioResult.Season = season
+		torrentioResult.Episode = episode
 		return torrentioResult, nil
 	}
 
-	logger.Debug("PARSER", "No season or episode information found in title '%s'", cleanTitle)
+	logger.DebugContext(ctx, "PARSER", "No season or episode information found in title '%s'", cleanTitle)
 	return torrentioResult, nil
 }
 
-func GetOrFetchEpisodes(imdbID string, start, end int, httpClient *api.APIClient, episodeCache *cache.EpisodeCache) int {
+// Packs report their episode count as files whenever it is known from TMDB, or was
+// estimated anyway to size the pack, even when their size doesn't need multiplying
+func setPackEpisodes(ctx context.Context, result *TorrentioResult, estimatePackSize bool, imdbID string, start, end int, httpClient *api.APIClient, episodeCache *cache.EpisodeCache) {
+	if !estimatePackSize && episodeCache == nil {
+		return
+	}
+
+	episodes := GetOrFetchEpisodes(ctx, imdbID, start, end, httpClient, episodeCache)
+	if estimatePackSize {
+		result.Size *= float64(episodes)
+	}
+	result.Files = episodes
+}
+
+func GetOrFetchEpisodes(ctx context.Context, imdbID string, start, end int, httpClient *api.APIClient, episodeCache *cache.EpisodeCache) int {
 	if episodeCache == nil {
 		return 10 * (end - start + 1)
 	}
 
 	episodes := 0
-	missing := false
+	found := 0
 
 	for i := start; i <= end; i++ {
 		if seasonEpisodes, exists := episodeCache.Get(imdbID, i); exists {
 			episodes += seasonEpisodes
-		} else {
-			missing = true
+			found++
 		}
 	}
 
-	if !missing {
+	if found == end-start+1 {
 		return episodes
 	}
 
-	tvDetails, err := httpClient.FetchTVShowDetails(imdbID)
+	// Once the search is out of time, estimate rather than wait on TMDB for every remaining stream
+	if err := ctx.Err(); err != nil {
+		logger.DebugContext(ctx, "TMDB", "Skipping episode count lookup for %s: %v", imdbID, err)
+		return 10 * (end - start + 1)
+	}
+
+	tvDetails, err := httpClient.FetchTVShowDetails(ctx, imdbID)
 	if err != nil {
-		logger.Error("TMDB", "Error fetching TV show details from TMDB: %v", err)
+		logger.ErrorContext(ctx, "TMDB", "Error fetching TV show details from TMDB: %v", err)
 		return 10 * (end - start + 1)
 	}
 
 	seasons, ok := tvDetails["seasons"].([]any)
 	if !ok {
-		logger.Error("TMDB", "Failed to get seasons from response")
+		logger.ErrorContext(ctx, "TMDB", "Failed to get seasons from response")
 		return 10 * (end - start + 1)
 	}
 
+	// Every season in the response is cached, e.g. all 5 when only 1-3 were asked for, to prevent
+	// redundant fetches later. The count comes from the response alone, as concurrent searches
+	// share it and may have cached some of these seasons since the lookup started
+	episodes, found = 0, 0
+
 	for _, season := range seasons {
 		seasonData, ok := season.(map[string]any)
 		if !ok {
-			logger.Warn("TMDB", "Could not parse season data from response for IMDB ID %s", imdbID)
+			logger.WarnContext(ctx, "TMDB", "Could not parse season data from response for IMDB ID %s", imdbID)
 			continue
 		}
 
 		seasonNumRaw, ok := seasonData["season_number"].(float64)
 		if !ok {
-			logger.Warn("TMDB", "Could not find season number in season data for IMDB ID %s", imdbID)
+			logger.WarnContext(ctx, "TMDB", "Could not find season number in season data for IMDB ID %s", imdbID)
 			continue
 		}
 		seasonNum := int(seasonNumRaw)
 
-		// Rechecking the cache allows us to store all seasons from the API response.
-		// e.g. if start=1 and end=3 but the show has 5 seasons,
-		// we cache them all now to prevent redundant fetches later.
-		if _, exists := episodeCache.Get(imdbID, seasonNum); exists {
-			continue
-		}
-
 		episodeCountRaw, ok := seasonData["episode_count"].(float64)
 		if !ok {
-			logger.Warn("TMDB", "Could not find episode count for season %d in season data for IMDB ID %s", seasonNum, imdbID)
+			logger.WarnContext(ctx, "TMDB", "Could not find episode count for season %d in season data for IMDB ID %s", seasonNum, imdbID)
 			continue
 		}
 		episodeCount := int(episodeCountRaw)
 
-		episodeCache.Set(imdbID, seasonNum, episodeCount)
-		episodes += episodeCount
+		airing := isSeasonAiring(tvDetails, seasonData, seasonNum)
+		logger.DebugContext(ctx, "TMDB", "Caching season %d of %s: episodes=%d, airing=%v", seasonNum, imdbID, episodeCount, airing)
+
+		episodeCache.Set(imdbID, seasonNum, episodeCount, airing)
+		if seasonNum >= start && seasonNum <= end {
+			episodes += episodeCount
+			found++
+		}
+	}
+
+	// Seasons TMDB doesn't know about yet are estimated like when it can't be reached
+	if missing := end - start + 1 - found; missing > 0 {
+		logger.DebugContext(ctx, "TMDB", "No episode count for %d of seasons %d-%d of %s, estimating", missing, start, end, imdbID)
+		episodes += 10 * missing
 	}
 
 	return episodes
 }
 
+func isSeasonAiring(tvDetails, seasonData map[string]any, seasonNum int) bool {
+	// Unaired seasons have no air date or one in the future, and their episode count is still growing
+	airDate, _ := time.Parse("2006-01-02", fmt.Sprint(seasonData["air_date"]))
+	if airDate.IsZero() || airDate.After(time.Now()) {
+		return true
+	}
+
+	if inProduction, _ := tvDetails["in_production"].(bool); !inProduction {
+		return false
+	}
+
+	for _, key := range []string{"next_episode_to_air", "last_episode_to_air"} {
+		if episode, ok := tvDetails[key].(map[string]any); ok {
+			if episodeSeason, ok := episode["season_number"].(float64); ok && int(episodeSeason) == seasonNum {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func parseTorrentioStream(ctx context.Context, stream api.Stream) (*TorrentioResult, error) {
+	if stream.Title == "" {
+		return nil, errors.New("missing title from result")
+	}
+	if stream.InfoHash == "" {
+		return nil, errors.New("missing infoHash from result")
+	}
+
+	logger.DebugContext(ctx, "PARSER", "Processing result: title=%s, infoHash=%s", stream.Title, stream.InfoHash)
+
+	torrentioResult := &TorrentioResult{
+		Title:    getCleanTitle(stream.Title),
+		InfoHash: stream.InfoHash,
+	}
+
+	parseInfo(stream.Title, torrentioResult)
+	return torrentioResult, nil
+}
+
+// Addons such as MediaFusion and Comet put the release name on the first line of the
+// description and the details below it using their own emoji. The filename is only a
+// fallback, as it names the video file inside the torrent, e.g. one episode of a pack
+func parseGenericStream(ctx context.Context, stream api.Stream) (*TorrentioResult, error) {
+	text := stream.Description
+	if text == "" {
+		text = stream.Title
+	}
+	if text == "" {
+		return nil, errors.New("missing title from result")
+	}
+	if stream.InfoHash == "" {
+		return nil, errors.New("missing infoHash from result")
+	}
+
+	logger.DebugContext(ctx, "PARSER", "Processing result: description=%s, infoHash=%s", text, stream.InfoHash)
+
+	title := strings.TrimLeftFunc(getCleanTitle(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if title == "" {
+		title = stream.BehaviorHints.Filename
+	}
+	if title == "" {
+		return nil, errors.New("missing title from result")
+	}
+
+	torrentioResult := &TorrentioResult{
+		Title:    title,
+		InfoHash: stream.InfoHash,
+		Source:   "Unknown",
+	}
+
+	if match := Regexes.Seeders.FindStringSubmatch(text); len(match) == 2 {
+		torrentioResult.Peers, _ = strconv.Atoi(match[1])
+	}
+	if match := Regexes.Size.FindStringSubmatch(text); len(match) == 3 {
+		torrentioResult.Size, _ = strconv.ParseFloat(match[1], 64)
+		switch match[2] {
+		case "TB":
+			torrentioResult.Size *= 1024
+		case "MB":
+			torrentioResult.Size /= 1024
+		}
+	}
+	if match := Regexes.Source.FindStringSubmatch(text); len(match) == 2 {
+		torrentioResult.Source = strings.TrimSpace(match[1])
+	}
+
+	return torrentioResult, nil
+}
+
 func parseInfo(title string, torrentioResult *TorrentioResult) {
 	peers := 0
 	size := float64(0)
@@ -198,6 +453,98 @@ func parseInfo(title string, torrentioResult *TorrentioResult) {
 	torrentioResult.Source = source
 }
 
+func ParseQuery(q string) SearchQuery {
+	title := strings.TrimSpace(strings.NewReplacer(".", " ", "_", " ").Replace(q))
+	searchQuery := SearchQuery{}
+
+	if loc := Regexes.SingleEpisode.FindStringSubmatchIndex(title); loc != nil {
+		searchQuery.Season, _ = strconv.Atoi(title[loc[2]:loc[3]])
+		searchQuery.Episode, _ = strconv.Atoi(title[loc[4]:loc[5]])
+		title = title[:loc[0]]
+	} else if loc := Regexes.Season.FindStringSubmatchIndex(title); loc != nil && loc[0] > 0 {
+		searchQuery.Season, _ = strconv.Atoi(title[loc[2]:loc[3]])
+		title = title[:loc[0]]
+	}
+
+	// A year at the very start is part of the title, e.g. "2012 2009"
+	if locs := Regexes.Year.FindAllStringSubmatchIndex(title, -1); len(locs) > 0 {
+		loc := locs[len(locs)-1]
+		if loc[0] > 0 {
+			searchQuery.Year, _ = strconv.Atoi(title[loc[2]:loc[3]])
+			title = title[:loc[0]]
+		}
+	}
+
+	searchQuery.Title = strings.Join(strings.Fields(strings.Trim(title, " -([")), " ")
+	return searchQuery
+}
+
+func getResolution(title string) string {
+	match := Regexes.Resolution.FindStringSubmatch(title)
+	if len(match) < 2 {
+		return ""
+	}
+
+	resolution := strings.ToLower(match[1])
+	if resolution == "4k" || resolution == "uhd" {
+		return "2160p"
+	}
+	return resolution
+}
+
+func getVideoCodec(title string) string {
+	if match := Regexes.VideoCodec.FindStringSubmatch(title); len(match) == 2 {
+		return videoCodecs[strings.ToLower(match[1])]
+	}
+	return ""
+}
+
+func getAudioCodec(title string) string {
+	if match := Regexes.AudioCodec.FindStringSubmatch(title); len(match) == 2 {
+		return audioCodecs[strings.ToLower(match[1])]
+	}
+	return ""
+}
+
+func getLanguages(title, details string) []string {
+	var found []string
+	add := func(language string) {
+		if language != "" && !slices.Contains(found, language) {
+			found = append(found, language)
+		}
+	}
+
+	for _, match := range Regexes.Flag.FindAllString(details, -1) {
+		code := ""
+		for _, r := range match {
+			code += string('a' + r - 0x1F1E6)
+		}
+		add(flagLanguages[code])
+	}
+	for _, match := range Regexes.Language.FindAllStringSubmatch(title, -1) {
+		add(titleLanguages[strings.ToLower(match[1])])
+	}
+
+	return found
+}
+
+func getCategory(baseCategory int, resolution string) int {
+	quality := ""
+	switch resolution {
+	case "2160p":
+		quality = "UHD"
+	case "1440p", "1080p", "720p":
+		quality = "HD"
+	case "576p", "480p", "360p":
+		quality = "SD"
+	}
+
+	if category, ok := subcategories[baseCategory][quality]; ok {
+		return category
+	}
+	return baseCategory
+}
+
 func getCleanTitle(title string) string {
 	return strings.Split(title, "\n")[0]
 }
@@ -227,6 +574,25 @@ func getSeasonNumber(title string) (int, bool) {
 	return 0, false
 }
 
+// Stremio streams list their peer sources as "tracker:<url>" and "dht:<hash>" entries
+func getTrackers(sources []string) []string {
+	var trackers []string
+	for _, source := range sources {
+		if tracker, found := strings.CutPrefix(source, "tracker:"); found && tracker != "" {
+			trackers = append(trackers, tracker)
+		}
+	}
+	return trackers
+}
+
+func getSingleEpisode(title string) (season, episode int) {
+	if match := Regexes.SingleEpisode.FindStringSubmatch(title); len(match) == 3 {
+		season, _ = strconv.Atoi(match[1])
+		episode, _ = strconv.Atoi(match[2])
+	}
+	return season, episode
+}
+
 func getEpisodeRange(title string) (start, end int, found bool) {
 	if match := Regexes.EpisodeRange.FindStringSubmatch(title); len(match) == 3 {
 		start, _ = strconv.Atoi(match[1])
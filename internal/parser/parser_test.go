@@ -0,0 +1,253 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tweakio/internal/api"
+	"tweakio/internal/cache"
+	"tweakio/internal/metrics"
+)
+
+func TestParseQuery(t *testing.T) {
+	if err := CompileRegex(); err != nil {
+		t.Fatalf("Failed to compile regex: %v", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected SearchQuery
+	}{
+		{"The Bear S02E03", SearchQuery{Title: "The Bear", Season: 2, Episode: 3}},
+		{"Dune 2021", SearchQuery{Title: "Dune", Year: 2021}},
+		{"Dune (2021)", SearchQuery{Title: "Dune", Year: 2021}},
+		{"The.Bear.S02", SearchQuery{Title: "The Bear", Season: 2}},
+		{"Chungus 2023 S01E01", SearchQuery{Title: "Chungus", Year: 2023, Season: 1, Episode: 1}},
+		{"2012", SearchQuery{Title: "2012"}},
+		{"Blade Runner 2049 2017", SearchQuery{Title: "Blade Runner 2049", Year: 2017}},
+		{"Chungus", SearchQuery{Title: "Chungus"}},
+	}
+
+	for _, test := range tests {
+		if got := ParseQuery(test.input); got != test.expected {
+			t.Errorf("Input '%s': expected %+v, got %+v", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestParseStreamFormats(t *testing.T) {
+	if err := CompileRegex(); err != nil {
+		t.Fatalf("Failed to compile regex: %v", err)
+	}
+
+	tests := []struct {
+		format   string
+		stream   api.Stream
+		expected TorrentioResult
+	}{
+		{
+			"torrentio",
+			api.Stream{
+				Name:     "Torrentio\n4k",
+				Title:    "Chungus.2021.2160p.WEB-DL.DDP5.1.x265\n👤 42 💾 20 GB ⚙️ ThePirateBay\nMulti Audio / 🇬🇧 / 🇮🇹",
+				InfoHash: "abc",
+				Sources:  []string{"tracker:udp://tracker.example:1337/announce", "dht:abc"},
+			},
+			TorrentioResult{Title: "Chungus.2021.2160p.WEB-DL.DDP5.1.x265", InfoHash: "abc", Peers: 42, Size: 20, Source: "ThePirateBay", Resolution: "2160p", VideoCodec: "x265", AudioCodec: "EAC3", Languages: []string{"English", "Italian"}, Trackers: []string{"udp://tracker.example:1337/announce"}, Category: 2030},
+		},
+		{
+			"mediafusion",
+			api.Stream{
+				Name:          "MediaFusion | 1080p",
+				Description:   "📂 Chungus.2021.1080p.BluRay.x264\n💾 1.5 GB 👤 7\n🔗 TorrentGalaxy",
+				InfoHash:      "def",
+				BehaviorHints: api.BehaviorHints{Filename: "Chungus.2021.mkv"},
+			},
+			TorrentioResult{Title: "Chungus.2021.1080p.BluRay.x264", InfoHash: "def", Peers: 7, Size: 1.5, Source: "TorrentGalaxy", Resolution: "1080p", VideoCodec: "x264", Category: 2010},
+		},
+		{
+			"generic",
+			api.Stream{
+				Description:   "\n💾 700 MB",
+				InfoHash:      "mno",
+				BehaviorHints: api.BehaviorHints{Filename: "Chungus.2021.720p.mkv"},
+			},
+			TorrentioResult{Title: "Chungus.2021.720p.mkv", InfoHash: "mno", Size: 700.0 / 1024, Source: "Unknown", Resolution: "720p", Category: 2010},
+		},
+		{
+			"comet",
+			api.Stream{
+				Description: "Chungus 2021 720p\n💾 700 MB 🔎 YTS",
+				InfoHash:    "ghi",
+			},
+			TorrentioResult{Title: "Chungus 2021 720p", InfoHash: "ghi", Size: 700.0 / 1024, Source: "YTS", Resolution: "720p", Category: 2010},
+		},
+	}
+
+	for _, test := range tests {
+		result, err := ParseResult(context.Background(), test.stream, Options{Format: test.format, EstimatePackSize: true}, "movie", "tt0000001", nil, nil)
+		if err != nil {
+			t.Errorf("Format '%s': unexpected error: %v", test.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(*result, test.expected) {
+			t.Errorf("Format '%s': expected %+v, got %+v", test.format, test.expected, *result)
+		}
+	}
+
+	if _, err := ParseResult(context.Background(), api.Stream{Description: "Chungus"}, Options{Format: "comet"}, "movie", "tt0000001", nil, nil); err == nil {
+		t.Errorf("Expected an error for a stream without an infoHash")
+	}
+	if _, err := ParseResult(context.Background(), api.Stream{Title: "Chungus"}, Options{Format: "torrentio"}, "movie", "tt0000001", nil, nil); err == nil {
+		t.Errorf("Expected an error for a Torrentio stream without an infoHash")
+	}
+
+	pack, err := ParseResult(context.Background(), api.Stream{Title: "Chungus.S01.1080p\n👤 5 💾 2 GB ⚙️ ThePirateBay", InfoHash: "jkl"}, Options{Format: "torrentio", EstimatePackSize: true}, "tvsearch", "tt0000001", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error for a season pack: %v", err)
+	}
+	if !pack.SeasonPack || pack.Files != 10 || pack.Size != 20 {
+		t.Errorf("Expected a season pack of 10 files and 20 GB, got %+v", *pack)
+	}
+
+	// The filename only names one episode of the pack
+	pack, err = ParseResult(context.Background(), api.Stream{Description: "📂 Chungus.S01.1080p\n💾 20 GB", InfoHash: "pqr", BehaviorHints: api.BehaviorHints{Filename: "Chungus.S01E03.mkv"}}, Options{Format: "mediafusion"}, "tvsearch", "tt0000001", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error for a MediaFusion season pack: %v", err)
+	}
+	if !pack.SeasonPack || pack.Title != "Chungus.S01.1080p" || pack.Files != 0 {
+		t.Errorf("Expected the MediaFusion season pack to keep its release name and no file count without TMDB, got %+v", *pack)
+	}
+
+	episodeCache := cache.CreateEpisodeCache(10, time.Hour, time.Hour)
+	episodeCache.Set("tt0000001", 1, 8, false)
+	pack, err = ParseResult(context.Background(), api.Stream{Description: "📂 Chungus.S01.1080p\n💾 20 GB", InfoHash: "pqr"}, Options{Format: "mediafusion"}, "tvsearch", "tt0000001", nil, episodeCache)
+	if err != nil {
+		t.Fatalf("Unexpected error for a MediaFusion season pack: %v", err)
+	}
+	if pack.Files != 8 || pack.Size != 20 {
+		t.Errorf("Expected the MediaFusion season pack to report 8 files and keep its 20 GB size, got %+v", *pack)
+	}
+}
+
+func TestGetOrFetchEpisodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/find/") {
+			w.Write([]byte(`{"tv_results":[{"id":1}]}`))
+			return
+		}
+		w.Write([]byte(`{"seasons":[{"season_number":1,"episode_count":8,"air_date":"2020-01-01"}]}`))
+	}))
+	defer server.Close()
+
+	client := &api.APIClient{Client: server.Client(), TMDBBaseURL: server.URL, TMDBAPIKey: "key"}
+	episodeCache := cache.CreateEpisodeCache(10, time.Hour, time.Hour)
+
+	tests := []struct {
+		start, end, expected int
+	}{
+		{1, 1, 8},
+		{2, 2, 10},
+		{1, 3, 28},
+	}
+
+	for _, test := range tests {
+		if got := GetOrFetchEpisodes(context.Background(), "tt0000001", test.start, test.end, client, episodeCache); got != test.expected {
+			t.Errorf("Seasons %d-%d: expected %d episodes, got %d", test.start, test.end, test.expected, got)
+		}
+	}
+}
+
+func TestGetOrFetchEpisodesConcurrently(t *testing.T) {
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/find/") {
+			w.Write([]byte(`{"tv_results":[{"id":1}]}`))
+			return
+		}
+		// Hold the lookup until every search is waiting on it
+		once.Do(func() { close(requested) })
+		<-release
+		w.Write([]byte(`{"seasons":[{"season_number":1,"episode_count":8,"air_date":"2020-01-01"}]}`))
+	}))
+	defer server.Close()
+
+	client := &api.APIClient{Client: server.Client(), TMDBBaseURL: server.URL, TMDBAPIKey: "key"}
+	episodeCache := cache.CreateEpisodeCache(10, time.Hour, time.Hour)
+
+	var started, wg sync.WaitGroup
+	results := make([]int, 5)
+	started.Add(len(results))
+	for i := range results {
+		wg.Go(func() {
+			started.Done()
+			results[i] = GetOrFetchEpisodes(context.Background(), "tt0000001", 1, 1, client, episodeCache)
+		})
+	}
+
+	started.Wait()
+	<-requested
+	close(release)
+	wg.Wait()
+
+	for i, result := range results {
+		if result != 8 {
+			t.Errorf("Search %d: expected 8 episodes, got %d", i, result)
+		}
+	}
+}
+
+func TestGetOrFetchEpisodesLookupMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/find/") {
+			w.Write([]byte(`{"tv_results":[{"id":1}]}`))
+			return
+		}
+		var seasons []string
+		for season := 1; season <= 10; season++ {
+			seasons = append(seasons, fmt.Sprintf(`{"season_number":%d,"episode_count":8,"air_date":"2020-01-01"}`, season))
+		}
+		w.Write([]byte(`{"seasons":[` + strings.Join(seasons, ",") + `]}`))
+	}))
+	defer server.Close()
+
+	client := &api.APIClient{Client: server.Client(), TMDBBaseURL: server.URL, TMDBAPIKey: "key"}
+	episodeCache := cache.CreateEpisodeCache(10, time.Hour, time.Hour)
+
+	misses := func() float64 {
+		var buf bytes.Buffer
+		metrics.WriteTo(&buf)
+		for line := range strings.SplitSeq(buf.String(), "\n") {
+			if value, found := strings.CutPrefix(line, `tweakio_cache_lookups_total{cache="episodes",result="miss"} `); found {
+				count, _ := strconv.ParseFloat(value, 64)
+				return count
+			}
+		}
+		return 0
+	}
+
+	// Caching the other seasons from the response must not count as lookups
+	before := misses()
+	GetOrFetchEpisodes(context.Background(), "tt0000001", 1, 1, client, episodeCache)
+	if after := misses(); after-before != 1 {
+		t.Errorf("Expected 1 miss, got %v", after-before)
+	}
+
+	before = misses()
+	if got := GetOrFetchEpisodes(context.Background(), "tt0000001", 2, 10, client, episodeCache); got != 72 {
+		t.Errorf("Expected 72 episodes from the cache, got %d", got)
+	}
+	if after := misses(); after != before {
+		t.Errorf("Expected no new misses, got %v", after-before)
+	}
+}
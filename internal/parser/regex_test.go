@@ -44,6 +44,19 @@ func TestCompiledRegexPatterns(t *testing.T) {
 			{"👤 0 💾 0 GB ⚙️ Unknown", true},
 			{"👤 1500 💾 2.33 GB ⚙️ CornHub", true},
 		},
+		"resolution": {
+			{"Chungus.2021.2160p.WEB-DL.DDP5.1.HDR.H.265", true},
+			{"Chungus.S01E01.1080p.WEB.h264", true},
+			{"Chungus 2021 4K HDR", true},
+			{"Chungus.2021.720p.BluRay", true},
+			{"Chungus.2021.DVDRip.480p", true},
+			{"Chungus.2021.DVDRip.XviD", false},
+			{"Chungus.21080p", false},
+		},
+		"year": {
+			{"Dune 2021", true}, {"Chungus (1999)", true},
+			{"Chungus 1080p", false}, {"Chungus 2160p", false},
+		},
 	}
 
 	failed := false
@@ -63,6 +76,10 @@ func TestCompiledRegexPatterns(t *testing.T) {
 				regex = Regexes.Episode
 			case "info":
 				regex = Regexes.Info
+			case "resolution":
+				regex = Regexes.Resolution
+			case "year":
+				regex = Regexes.Year
 			default:
 				t.Fatalf("Unknown regex pattern: %s", pattern)
 			}
@@ -3,28 +3,54 @@ package torznab
 import (
 	"encoding/xml"
 	"fmt"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"tweakio/internal/parser"
 )
 
+const (
+	DefaultLimit = 50
+	MaxLimit     = 100
+)
+
+// Error codes from the Newznab API specification, which Torznab reuses
+const (
+	ErrorIncorrectCredentials = 100
+	ErrorMissingParameter     = 200
+	ErrorIncorrectParameter   = 201
+	ErrorNoSuchFunction       = 202
+	ErrorFunctionUnavailable  = 203
+	ErrorRequestLimitReached  = 500
+	ErrorUnknown              = 900
+)
+
 type TorznabResponse struct {
-	XMLName xml.Name       `xml:"rss"`
-	Version string         `xml:"version,attr"`
-	XMLNS   string         `xml:"xmlns:torznab,attr"`
-	Channel TorznabChannel `xml:"channel"`
+	XMLName      xml.Name       `xml:"rss"`
+	Version      string         `xml:"version,attr"`
+	XMLNS        string         `xml:"xmlns:torznab,attr"`
+	XMLNSNewznab string         `xml:"xmlns:newznab,attr"`
+	Channel      TorznabChannel `xml:"channel"`
 }
 
 type TorznabChannel struct {
-	Title       string        `xml:"title"`
-	Description string        `xml:"description"`
-	Link        string        `xml:"link"`
-	Items       []TorznabItem `xml:"item"`
+	Title       string          `xml:"title"`
+	Description string          `xml:"description"`
+	Link        string          `xml:"link"`
+	Response    NewznabResponse `xml:"newznab:response"`
+	Items       []TorznabItem   `xml:"item"`
+}
+
+type NewznabResponse struct {
+	Offset int `xml:"offset,attr"`
+	Total  int `xml:"total,attr"`
 }
 
 type TorznabItem struct {
 	Title       string           `xml:"title"`
 	Link        string           `xml:"link"`
-	GUID        string           `xml:"guid"`
+	GUID        TorznabGUID      `xml:"guid"`
 	Size        int64            `xml:"size"`
 	InfoHash    string           `xml:"infohash"`
 	Description string           `xml:"description,omitempty"`
@@ -33,6 +59,11 @@ type TorznabItem struct {
 	Attributes  []TorznabAttr    `xml:"torznab:attr"`
 }
 
+type TorznabGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
 type TorznabEnclosure struct {
 	URL    string `xml:"url,attr"`
 	Length int64  `xml:"length,attr"`
@@ -44,22 +75,94 @@ type TorznabAttr struct {
 	Value string `xml:"value,attr"`
 }
 
-func ConvertToTorznab(results []parser.TorrentioResult, baseURL string) (string, error) {
-	var items []TorznabItem
+// Added to every magnet link after the trackers reported by the addon
+var DefaultTrackers []string
+
+// What the client searched for, used to tag results with the IDs they were found by
+type SearchContext struct {
+	IMDbID  string
+	TMDBID  string
+	TVDBID  string
+	Season  int
+	Episode int
+}
+
+func Paginate(results []parser.TorrentioResult, offset, limit int) []parser.TorrentioResult {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(results) {
+		return nil
+	}
+
+	end := min(offset+limit, len(results))
+	return results[offset:end]
+}
 
+func Deduplicate(results []parser.TorrentioResult) []parser.TorrentioResult {
+	var unique []parser.TorrentioResult
+	seen := make(map[string]bool)
 	for _, r := range results {
-		magnetLink := "magnet:?xt=urn:btih:" + r.InfoHash
+		infoHash := strings.ToLower(r.InfoHash)
+		if seen[infoHash] {
+			continue
+		}
+		seen[infoHash] = true
+		unique = append(unique, r)
+	}
+	return unique
+}
+
+func FilterByCategories(results []parser.TorrentioResult, categories []int) []parser.TorrentioResult {
+	if len(categories) == 0 {
+		return results
+	}
 
-		attrs := []TorznabAttr{
-			{"category", strconv.Itoa(r.Category)},
-			{"seeders", strconv.Itoa(r.Peers)},
-			{"source", r.Source + " (Tweakio)"},
+	var filtered []parser.TorrentioResult
+	for _, r := range results {
+		if MatchesCategories(r.Category, categories) {
+			filtered = append(filtered, r)
 		}
+	}
+	return filtered
+}
+
+func MatchesCategories(category int, categories []int) bool {
+	for _, c := range categories {
+		// A parent category such as 2000 matches all of its subcategories
+		if c == category || (c%1000 == 0 && c == category/1000*1000) {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseCategories(raw string) []int {
+	var categories []int
+	for part := range strings.SplitSeq(raw, ",") {
+		if category, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+func ConvertToTorznab(results []parser.TorrentioResult, search SearchContext, baseURL, apiPath string, offset, total int) (string, error) {
+	var items []TorznabItem
+
+	for _, r := range results {
+		magnetLink := MagnetLink(r)
 
-		item := TorznabItem{
+		items = append(items, TorznabItem{
 			Title:    r.Title,
 			Link:     magnetLink,
-			GUID:     r.InfoHash,
+			GUID:     TorznabGUID{Value: baseURL + "/torrent/" + r.InfoHash},
 			Size:     int64(r.Size * 1024 * 1024 * 1024),
 			InfoHash: r.InfoHash,
 			PubDate:  "Mon, 01 Jan 2024 00:00:00 +0000",
@@ -68,19 +171,23 @@ func ConvertToTorznab(results []parser.TorrentioResult, baseURL string) (string,
 				Length: int64(r.Size * 1024 * 1024 * 1024),
 				Type:   "application/x-bittorrent",
 			},
-			Attributes: attrs,
-		}
-		items = append(items, item)
+			Attributes: attributes(r, search),
+		})
 	}
 
 	response := TorznabResponse{
-		Version: "2.0",
-		XMLNS:   "http://torznab.com/schemas/2015/feed",
+		Version:      "2.0",
+		XMLNS:        "http://torznab.com/schemas/2015/feed",
+		XMLNSNewznab: "http://www.newznab.com/DTD/2010/feeds/attributes/",
 		Channel: TorznabChannel{
 			Title:       "Tweakio",
 			Description: "Generated by Tweakio",
-			Link:        baseURL,
-			Items:       items,
+			Link:        baseURL + apiPath,
+			Response: NewznabResponse{
+				Offset: offset,
+				Total:  total,
+			},
+			Items: items,
 		},
 	}
 
@@ -92,7 +199,77 @@ func ConvertToTorznab(results []parser.TorrentioResult, baseURL string) (string,
 	return xml.Header + string(output), nil
 }
 
-func GenerateFakeResults() (string, error) {
+func MagnetLink(r parser.TorrentioResult) string {
+	link := "magnet:?xt=urn:btih:" + r.InfoHash
+	if r.Title != "" {
+		link += "&dn=" + url.QueryEscape(r.Title)
+	}
+
+	seen := make(map[string]bool)
+	for _, tracker := range append(slices.Clone(r.Trackers), DefaultTrackers...) {
+		if seen[tracker] {
+			continue
+		}
+		seen[tracker] = true
+		link += "&tr=" + url.QueryEscape(tracker)
+	}
+	return link
+}
+
+func attributes(r parser.TorrentioResult, search SearchContext) []TorznabAttr {
+	attrs := []TorznabAttr{
+		{"category", strconv.Itoa(r.Category)},
+		{"seeders", strconv.Itoa(r.Peers)},
+		// Addons only report seeders, so they are the best known lower bound for peers.
+		// Leechers and grabs are left out rather than reported as 0
+		{"peers", strconv.Itoa(r.Peers)},
+		// Public trackers have no ratio to keep, so downloads are treated as freeleech
+		{"downloadvolumefactor", "0"},
+		{"uploadvolumefactor", "1"},
+	}
+
+	if search.IMDbID != "" {
+		attrs = append(attrs, TorznabAttr{"imdbid", search.IMDbID}, TorznabAttr{"imdb", strings.TrimPrefix(search.IMDbID, "tt")})
+	}
+	if search.TMDBID != "" {
+		attrs = append(attrs, TorznabAttr{"tmdbid", search.TMDBID})
+	}
+	if search.TVDBID != "" {
+		attrs = append(attrs, TorznabAttr{"tvdbid", search.TVDBID})
+	}
+
+	season, episode := r.Season, r.Episode
+	// Fall back to the searched episode when the title doesn't say, since addons are queried for that episode
+	if season == 0 && !r.SeasonPack {
+		season, episode = search.Season, search.Episode
+	}
+	if season > 0 {
+		attrs = append(attrs, TorznabAttr{"season", strconv.Itoa(season)})
+	}
+	if episode > 0 {
+		attrs = append(attrs, TorznabAttr{"episode", strconv.Itoa(episode)})
+	}
+
+	if r.Files > 0 {
+		attrs = append(attrs, TorznabAttr{"files", strconv.Itoa(r.Files)})
+	}
+	if r.Resolution != "" {
+		attrs = append(attrs, TorznabAttr{"resolution", r.Resolution})
+	}
+	if r.VideoCodec != "" {
+		attrs = append(attrs, TorznabAttr{"video", r.VideoCodec})
+	}
+	if r.AudioCodec != "" {
+		attrs = append(attrs, TorznabAttr{"audio", r.AudioCodec})
+	}
+	if len(r.Languages) > 0 {
+		attrs = append(attrs, TorznabAttr{"language", strings.Join(r.Languages, ", ")})
+	}
+
+	return append(attrs, TorznabAttr{"source", r.Source + " (Tweakio)"})
+}
+
+func GenerateFakeResults(baseURL, apiPath string) (string, error) {
 	fakeMovie := parser.TorrentioResult{
 		Title:    "No results! Make sure to use the IMDb ID to search",
 		InfoHash: "b13d60bd404b65c7484115aa863c8341a8092f55",
@@ -109,7 +286,21 @@ func GenerateFakeResults() (string, error) {
 		Category: 5000,
 		Source:   "FakeIndexer",
 	}
-	return ConvertToTorznab([]parser.TorrentioResult{fakeMovie, fakeShow}, "http://tweakio:3185/api")
+	return ConvertToTorznab([]parser.TorrentioResult{fakeMovie, fakeShow}, SearchContext{}, baseURL, apiPath, 0, 2)
+}
+
+type TorznabError struct {
+	XMLName     xml.Name `xml:"error"`
+	Code        int      `xml:"code,attr"`
+	Description string   `xml:"description,attr"`
+}
+
+func ErrorResponse(code int, description string) string {
+	output, err := xml.Marshal(TorznabError{Code: code, Description: description})
+	if err != nil {
+		return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><error code="%d" description="Unknown error"/>`, code)
+	}
+	return xml.Header + string(output)
 }
 
 func RssResponse() string {
@@ -120,12 +311,12 @@ func CapsResponse() string {
 	return `<?xml version="1.0" encoding="UTF-8"?>
 	<caps>
 		<server version="1.0" title="Tweakio"/>
-		<limits max="100" default="50"/>
+		<limits max="` + strconv.Itoa(MaxLimit) + `" default="` + strconv.Itoa(DefaultLimit) + `"/>
 		<registration available="no" open="no"/>
 		<searching>
 			<search available="yes" supportedParams="q"/>
-			<tv-search available="yes" supportedParams="q,season,ep,imdbid"/>
-			<movie-search available="yes" supportedParams="q,imdbid"/>
+			<tv-search available="yes" supportedParams="q,season,ep,imdbid,tvdbid,tmdbid"/>
+			<movie-search available="yes" supportedParams="q,imdbid,tmdbid"/>
 		</searching>
 		<categories>
 			<category id="2000" name="Movies">
@@ -0,0 +1,118 @@
+package torznab
+
+import (
+	"strings"
+	"testing"
+	"tweakio/internal/parser"
+)
+
+func TestPaginate(t *testing.T) {
+	results := make([]parser.TorrentioResult, 120)
+
+	tests := []struct {
+		offset, limit, expected int
+	}{
+		{0, 0, DefaultLimit},
+		{0, 10, 10},
+		{0, 500, MaxLimit},
+		{110, 50, 10},
+		{200, 50, 0},
+		{-5, 10, 10},
+	}
+
+	for _, test := range tests {
+		if got := len(Paginate(results, test.offset, test.limit)); got != test.expected {
+			t.Errorf("offset=%d limit=%d: expected %d results, got %d", test.offset, test.limit, test.expected, got)
+		}
+	}
+}
+
+func TestMatchesCategories(t *testing.T) {
+	tests := []struct {
+		category   int
+		categories []int
+		expected   bool
+	}{
+		{2030, []int{2030}, true},
+		{2030, []int{2000}, true},
+		{2010, []int{2030}, false},
+		{2000, []int{2030}, false},
+		{5050, []int{2000, 5050}, true},
+		{5040, []int{2000}, false},
+	}
+
+	for _, test := range tests {
+		if got := MatchesCategories(test.category, test.categories); got != test.expected {
+			t.Errorf("category=%d categories=%v: expected %v, got %v", test.category, test.categories, test.expected, got)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	response := ErrorResponse(ErrorIncorrectCredentials, `Incorrect "credentials"`)
+	if !strings.Contains(response, `<error code="100" description="Incorrect &#34;credentials&#34;"></error>`) {
+		t.Errorf("Unexpected error response: %s", response)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	search := SearchContext{IMDbID: "tt0000001", TVDBID: "42", Season: 2, Episode: 3}
+
+	tests := []struct {
+		result   parser.TorrentioResult
+		expected map[string]string
+		missing  []string
+	}{
+		{
+			parser.TorrentioResult{Season: 2, Episode: 3, VideoCodec: "x265"},
+			map[string]string{"imdb": "0000001", "imdbid": "tt0000001", "tvdbid": "42", "season": "2", "episode": "3", "video": "x265"},
+			[]string{"tmdbid", "files", "audio"},
+		},
+		{
+			parser.TorrentioResult{Season: 2, SeasonPack: true},
+			map[string]string{"season": "2"},
+			[]string{"episode"},
+		},
+		{
+			parser.TorrentioResult{},
+			map[string]string{"season": "2", "episode": "3", "downloadvolumefactor": "0", "uploadvolumefactor": "1"},
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		attrs := make(map[string]string)
+		for _, attr := range attributes(test.result, search) {
+			attrs[attr.Name] = attr.Value
+		}
+		for name, value := range test.expected {
+			if attrs[name] != value {
+				t.Errorf("Case %d: expected %s=%q, got %q", i, name, value, attrs[name])
+			}
+		}
+		for _, name := range test.missing {
+			if _, found := attrs[name]; found {
+				t.Errorf("Case %d: expected no %s attribute", i, name)
+			}
+		}
+	}
+}
+
+func TestMagnetLink(t *testing.T) {
+	DefaultTrackers = []string{"udp://a.example:1337/announce", "udp://b.example:80/announce"}
+	defer func() { DefaultTrackers = nil }()
+
+	result := parser.TorrentioResult{
+		Title:    "Chungus 2021 1080p",
+		InfoHash: "abc",
+		Trackers: []string{"udp://b.example:80/announce", "http://c.example/announce"},
+	}
+	expected := "magnet:?xt=urn:btih:abc&dn=Chungus+2021+1080p" +
+		"&tr=udp%3A%2F%2Fb.example%3A80%2Fannounce" +
+		"&tr=http%3A%2F%2Fc.example%2Fannounce" +
+		"&tr=udp%3A%2F%2Fa.example%3A1337%2Fannounce"
+
+	if got := MagnetLink(result); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}